@@ -1,28 +1,596 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"compress/gzip"
+	"compress/zlib"
 	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"hash"
+	"hash/crc32"
+	"html"
 	"io"
+	"maps"
+	"math"
 	"math/rand"
 	"net"
 	"net/http"
+	"net/http/httptrace"
+	"net/http/httputil"
+	"net/url"
 	"os"
 	"os/signal"
+	"runtime"
+	"runtime/pprof"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"syscall"
 	"time"
 )
 
 var shutdownInitiated = atomic.Bool{}
+
+// initialized is set once startup completed, see /startup.
+var initialized = atomic.Bool{}
+
+// shutdownStarted is closed when shutdownInitiated is set, so that handlers of
+// long-lived responses can wind down.
+var shutdownStarted = make(chan struct{})
+
+// notReady is set as soon as shutdown is requested, so that load balancers
+// start deregistering the server during the pre-shutdown sleep, while requests
+// are still served normally until shutdownInitiated is set.
+var notReady = atomic.Bool{}
+
+// keepAlivesDisabled mirrors server.SetKeepAlivesEnabled(false), which the
+// drain calls unless its strategy keeps existing connections open.
+var keepAlivesDisabled = atomic.Bool{}
 var shutdownTimer atomic.Pointer[time.Timer]
-var gracefulShutdown = os.Getenv("GRACEFUL_SHUTDOWN") == "true"
-var shutdownSleepDuration = 10 * time.Second
+var drainDeadline atomic.Pointer[time.Time]
+var gracefulShutdown = envBool("GRACEFUL_SHUTDOWN", false)
+var shutdownSleepDuration = envDuration("SHUTDOWN_SLEEP", 10*time.Second)
+var listenAddr = envString("LISTEN_ADDR", ":8080")
 var numConnections atomic.Int32
 
-const clientSideIdleTimeout = 15 * time.Second
+// totalConnections counts all connections ever accepted.
+var totalConnections atomic.Int64
+var maxTotalRequests = envInt("MAX_TOTAL_REQUESTS", 0)
+var maxURLLength = envInt("MAX_URL_LENGTH", 8192)
+var dnsCacheTTL = envDuration("DNS_CACHE_TTL", 0)
+var resolverCache *dnsCache
+var keepAliveViolations = envBool("KEEPALIVE_VIOLATIONS", false)
+var loadPattern = envString("LOAD_PATTERN", "")
+var loadTarget = envString("LOAD_TARGET", localURL(listenAddr)+"/sleep?min=10ms&max=100ms")
+var loadAmplitude = envInt("LOAD_AMPLITUDE", 10)
+var loadPeriod = envDuration("LOAD_PERIOD", time.Minute)
+var acceptDelay = envDuration("ACCEPT_DELAY", 0)
+var startTime time.Time
+var maxConnsPerIP = envInt("MAX_CONNS_PER_IP", 0)
+var shedThreshold = envInt("SHED_CONN_THRESHOLD", 0)
+var shedLimit = envInt("SHED_CONN_LIMIT", 0)
+
+// sleepPerConnection is added to every /sleep for each open connection to
+// simulate contention, overridable with per_conn=<duration>. The total is
+// capped like the samples of the continuous distributions.
+var sleepPerConnection = envDuration("SLEEP_PER_CONNECTION", 0)
+
+// maxSleepSample caps the samples of the continuous /sleep distributions,
+// whose long tails would otherwise produce hour-long sleeps now and then.
+var maxSleepSample = envDuration("MAX_SLEEP_SAMPLE", time.Minute)
+var acceptStopWindow = envDuration("ACCEPT_STOP_WINDOW", 0)
+var dialDelays = envDurationMap("DIAL_DELAY")
+var keepAliveHeaderTimeout = envDuration("KEEPALIVE_HEADER_TIMEOUT", 0)
+var keepAliveHeaderMax = envInt("KEEPALIVE_HEADER_MAX", 0)
+var keepAliveEnforceMax = envBool("KEEPALIVE_ENFORCE_MAX", false)
+var adminToken = envString("ADMIN_TOKEN", "")
+var watchdogThreshold = envDuration("WATCHDOG_THRESHOLD", 0)
+var watchdogGoroutineDump = envBool("WATCHDOG_GOROUTINE_DUMP", false)
+var faultInjection = envBool("FAULT_INJECTION", false)
+var dropCloseHeaderRate = envFloat("FAULT_DROP_CLOSE_HEADER_RATE", 0)
+var corsAllowedOrigins = envList("CORS_ALLOWED_ORIGINS")
+var corsAllowedMethods = envString("CORS_ALLOWED_METHODS", "GET, POST, PUT, DELETE, OPTIONS")
+var corsAllowedHeaders = envString("CORS_ALLOWED_HEADERS", "")
+var corsAllowCredentials = envBool("CORS_ALLOW_CREDENTIALS", false)
+var corsMaxAge = envDuration("CORS_MAX_AGE", 0)
+var verbose = envBool("VERBOSE", false)
+var drainP99Multiplier = envFloat("DRAIN_P99_MULTIPLIER", 0)
+var tcpNoDelay = envBool("TCP_NODELAY", true)
+var warmPoolSize = envInt("WARM_POOL_SIZE", 0)
+var warmPoolServices = envList("WARM_POOL_SERVICES")
+var warmPoolTimeout = envDuration("WARM_POOL_TIMEOUT", 5*time.Second)
+var drainBatchSize = envInt("DRAIN_BATCH_SIZE", 0)
+var drainBatchInterval = envDuration("DRAIN_BATCH_INTERVAL", time.Second)
+var connDebugHeaders = envBool("CONN_DEBUG_HEADERS", false)
+var selfURL = envString("SELF_URL", localURL(listenAddr))
+var h2c = envBool("H2C", false)
+var http2MaxConcurrentStreams = envInt("HTTP2_MAX_CONCURRENT_STREAMS", 0)
+var drainCloseListener = envBool("DRAIN_CLOSE_LISTENER", false)
+var drainCloseListenerAfter = envDuration("DRAIN_CLOSE_LISTENER_AFTER", 0)
+var minDrainDuration = envDuration("MIN_DRAIN_DURATION", 0)
+var deregistrationURL = envString("DEREGISTRATION_URL", "")
+var deregistrationStatus = envInt("DEREGISTRATION_STATUS", http.StatusOK)
+var deregistrationBody = envString("DEREGISTRATION_BODY", "")
+var deregistrationPollInterval = envDuration("DEREGISTRATION_POLL_INTERVAL", time.Second)
+var maxRequestDuration = envDuration("MAX_REQUEST_DURATION", 0)
+var routeRequestDurations = envDurationMap("ROUTE_MAX_REQUEST_DURATION")
+var connResetAfterIdle = envDuration("CONN_RESET_AFTER_IDLE", 0)
+var connStaleAge = envDuration("CONN_STALE_AGE", time.Minute)
+var firstRequestDelay = envDuration("FIRST_REQUEST_DELAY", 0)
+var firstRequestHeader = envBool("FIRST_REQUEST_HEADER", false)
+var replayRecordPath = envString("REPLAY_RECORD_PATH", "")
+var replayRecordMax = envInt("REPLAY_RECORD_MAX", 10000)
+var hostRequired = envBool("HOST_REQUIRED", false)
+var proxyTimeoutBudget = envDuration("PROXY_TIMEOUT_BUDGET", 0)
+var compressionAlgorithms = envList("COMPRESSION")
+var compressionLevel = envInt("COMPRESSION_LEVEL", 6)
+var affinityCookie = envString("AFFINITY_COOKIE", "")
+var affinityCookieTTL = envDuration("AFFINITY_COOKIE_TTL", 0)
+var tlsCertFile = envString("TLS_CERT_FILE", "")
+var tlsKeyFile = envString("TLS_KEY_FILE", "")
+var tlsSessionTickets = envBool("TLS_SESSION_TICKETS", true)
+var socketReadBuffer = envInt("SOCKET_READ_BUFFER", 0)
+var socketWriteBuffer = envInt("SOCKET_WRITE_BUFFER", 0)
+var sseShutdownNotify = envBool("SSE_SHUTDOWN_NOTIFY", true)
+var maxIdleBeforeShutdown = envDuration("MAX_IDLE_BEFORE_SHUTDOWN", 0)
+var connCloseEvents = envBool("CONN_CLOSE_EVENTS", false)
+var connTimelines = envBool("CONN_TIMELINE", false)
+var connTimelineMaxEvents = envInt("CONN_TIMELINE_MAX_EVENTS", 100)
+var halfCloseMode = envString("HALF_CLOSE", "")
+var pipelineLog = envBool("PIPELINE_LOG", false)
+var pipelineDelay = envDuration("PIPELINE_DELAY", 0)
+var connSnapshotFile = envString("CONN_SNAPSHOT_FILE", "")
+var connSnapshotInterval = envDuration("CONN_SNAPSHOT_INTERVAL", time.Second)
+var flushInterval = envDuration("FLUSH_INTERVAL", 0)
+var rawResponses = envBool("RAW_RESPONSES", false)
+var slowBodyReads = envBool("SLOW_BODY_READS", false)
+var maxAlloc = envInt("MAX_ALLOC", 256<<20)
+var fanOutConcurrency = envInt("FAN_OUT_CONCURRENCY", 4)
+var fanOutTimeout = envDuration("FAN_OUT_TIMEOUT", 10*time.Second)
+var maxProxyHops = envInt("MAX_PROXY_HOPS", 10)
+
+// proxyCompressionPassthrough controls how proxy deals with compressed upstream
+// responses. By default, the transport requests gzip on its own and
+// transparently decompresses the upstream body, so no Content-Encoding must be
+// forwarded to the client. With PROXY_COMPRESSION=passthrough, transparent
+// decompression is disabled and the client's Accept-Encoding as well as the
+// upstream's Content-Encoding are forwarded along with the body verbatim.
+var proxyCompressionPassthrough = envString("PROXY_COMPRESSION", "decompress") == "passthrough"
+var startupSelfTest = envBool("STARTUP_SELFTEST", false)
+var selfTestRequired = envList("STARTUP_SELFTEST_REQUIRED")
+var totalRequests atomic.Int64
+
+// shutdownRequested is signalled once to make main run the shutdown sequence.
+var shutdownRequested = make(chan struct{}, 1)
+
+// clientSideIdleTimeout is the longest idle timeout assumed for clients, which
+// is how long the drain waits for them to close their connections by default.
+var clientSideIdleTimeout = envDuration("DRAIN_TIMEOUT", 15*time.Second)
+
+// proxyHopsHeader counts the proxy invocations a request went through, see
+// proxy and withHopLimit.
+const proxyHopsHeader = "X-Proxy-Hops"
+
+// timeoutBudgetHeader carries the time left for the whole proxy chain as a
+// duration, see proxy.
+const timeoutBudgetHeader = "X-Timeout-Budget"
+const selfTestTimeout = 2 * time.Second
+
+// backends are the services that requests can be proxied to via /<service>/.
+var backends = envListOr("BACKENDS", []string{"envoy", "nginx", "varnish", "node-demo", "java-demo"})
+
+// configValues holds the effective value of every environment variable read
+// via the env* functions.
+var configValues = make(map[string]string)
+
+// envString returns the environment variable name, or def if it is unset.
+func envString(name, def string) string {
+	v := os.Getenv(name)
+	if v == "" {
+		v = def
+	}
+	configValues[name] = v
+	return v
+}
+
+// envBool returns whether the environment variable name is "true", or def if it is unset.
+func envBool(name string, def bool) bool {
+	b := def
+	if v := os.Getenv(name); v != "" {
+		b = v == "true"
+	}
+	configValues[name] = strconv.FormatBool(b)
+	return b
+}
+
+// envInt parses the integer environment variable name, returning def if it is unset.
+func envInt(name string, def int64) int64 {
+	v := os.Getenv(name)
+	if v == "" {
+		configValues[name] = strconv.FormatInt(def, 10)
+		return def
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "%v: invalid %v: %v\n", time.Now().Format(time.RFC3339), name, err)
+		os.Exit(1)
+	}
+	configValues[name] = v
+	return n
+}
+
+// envFloat parses the floating point environment variable name, returning def if it is unset.
+func envFloat(name string, def float64) float64 {
+	v := os.Getenv(name)
+	if v == "" {
+		configValues[name] = strconv.FormatFloat(def, 'g', -1, 64)
+		return def
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "%v: invalid %v: %v\n", time.Now().Format(time.RFC3339), name, err)
+		os.Exit(1)
+	}
+	configValues[name] = v
+	return f
+}
+
+// envDuration parses the duration environment variable name, returning def if it is unset.
+func envDuration(name string, def time.Duration) time.Duration {
+	v := os.Getenv(name)
+	if v == "" {
+		configValues[name] = def.String()
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "%v: invalid %v: %v\n", time.Now().Format(time.RFC3339), name, err)
+		os.Exit(1)
+	}
+	configValues[name] = v
+	return d
+}
+
+// envDurationMap parses the environment variable name of the form
+// "key1=duration1,key2=duration2".
+func envDurationMap(name string) map[string]time.Duration {
+	m := make(map[string]time.Duration)
+	for _, kv := range envList(name) {
+		k, v, ok := strings.Cut(kv, "=")
+		d, err := time.ParseDuration(v)
+		if !ok || err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "%v: invalid %v: %v\n", time.Now().Format(time.RFC3339), name, kv)
+			os.Exit(1)
+		}
+		m[strings.TrimSpace(k)] = d
+	}
+	configValues[name] = os.Getenv(name)
+	return m
+}
+
+// envList parses the comma-separated environment variable name, skipping empty elements.
+func envList(name string) []string {
+	var list []string
+	for _, v := range strings.Split(os.Getenv(name), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	configValues[name] = strings.Join(list, ",")
+	return list
+}
+
+// envListOr parses the comma-separated environment variable name like envList,
+// returning def if it is unset or empty.
+func envListOr(name string, def []string) []string {
+	list := envList(name)
+	if len(list) == 0 {
+		configValues[name] = strings.Join(def, ",")
+		return def
+	}
+	return list
+}
+
+// localURL returns the URL under which the server listening on addr reaches
+// itself, which is localhost on the port of addr.
+func localURL(addr string) string {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil || port == "" {
+		port = "8080"
+	}
+	return "http://" + net.JoinHostPort("localhost", port)
+}
+
+// requestShutdown makes main run the shutdown sequence. It never blocks and
+// calling it more than once has no further effect.
+func requestShutdown() {
+	if !notReady.Swap(true) {
+		_, _ = fmt.Printf("%v: shutdown requested, reporting not ready\n", time.Now().Format(time.RFC3339))
+	}
+	select {
+	case shutdownRequested <- struct{}{}:
+	default:
+	}
+}
+
+// withMaxURLLength rejects requests whose path or request URI is longer than
+// maxURLLength with 414 URI Too Long. A non-positive limit disables the check.
+func withMaxURLLength(next http.Handler) http.Handler {
+	if maxURLLength <= 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if int64(len(r.URL.Path)) > maxURLLength || int64(len(r.RequestURI)) > maxURLLength {
+			http.Error(w, "URI too long\n", http.StatusRequestURITooLong)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// proxyHops returns the number of hops recorded in the proxyHopsHeader of r.
+func proxyHops(r *http.Request) (int64, error) {
+	v := r.Header.Get(proxyHopsHeader)
+	if v == "" {
+		return 0, nil
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid %v header %q", proxyHopsHeader, v)
+	}
+	return n, nil
+}
+
+// withHopLimit rejects requests that went through more than maxProxyHops
+// proxy hops with 508 Loop Detected, which stops proxy loops from recursing
+// forever. A non-positive limit disables the check.
+func withHopLimit(next http.Handler) http.Handler {
+	if maxProxyHops <= 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hops, err := proxyHops(r)
+		if err != nil {
+			http.Error(w, "Invalid "+proxyHopsHeader+" header\n", http.StatusBadRequest)
+			return
+		}
+		if hops > maxProxyHops {
+			_, _ = fmt.Fprintf(os.Stderr, "%v: rejecting request to %v after %d proxy hops\n", time.Now().Format(time.RFC3339), r.URL.Path, hops)
+			http.Error(w, "Loop detected\n", http.StatusLoopDetected)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// withHostRequired rejects requests without a Host header with 400 Bad
+// Request if HOST_REQUIRED is set. net/http already does so for HTTP/1.1, but
+// accepts HTTP/1.0 requests without one.
+func withHostRequired(next http.Handler) http.Handler {
+	if !hostRequired {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Host == "" {
+			http.Error(w, "Missing Host header\n", http.StatusBadRequest)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// withCORS answers CORS preflight requests and adds CORS headers to responses
+// for requests from origins in CORS_ALLOWED_ORIGINS ("*" allows any origin).
+func withCORS(next http.Handler) http.Handler {
+	if len(corsAllowedOrigins) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Origin")
+		if !slices.Contains(corsAllowedOrigins, "*") && !slices.Contains(corsAllowedOrigins, origin) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if slices.Contains(corsAllowedOrigins, "*") && !corsAllowCredentials {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+		} else {
+			// credentials can't be combined with a wildcard origin
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+		}
+		if corsAllowCredentials {
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+		}
+		if r.Method != http.MethodOptions || r.Header.Get("Access-Control-Request-Method") == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		// preflight request, answered without invoking next
+		w.Header().Set("Access-Control-Allow-Methods", corsAllowedMethods)
+		if corsAllowedHeaders != "" {
+			w.Header().Set("Access-Control-Allow-Headers", corsAllowedHeaders)
+		} else if reqHeaders := r.Header.Get("Access-Control-Request-Headers"); reqHeaders != "" {
+			w.Header().Set("Access-Control-Allow-Headers", reqHeaders)
+		}
+		if corsMaxAge > 0 {
+			w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(corsMaxAge.Seconds())))
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// shedRequests counts the requests rejected by withLoadShedding.
+var shedRequests atomic.Int64
+
+// connSaturation returns the open connections relative to SHED_CONN_LIMIT and
+// the fraction of requests to shed at that level, which grows linearly from 0
+// at SHED_CONN_THRESHOLD connections to 1 at SHED_CONN_LIMIT.
+func connSaturation() (saturation, shedFraction float64) {
+	if shedLimit <= 0 {
+		return 0, 0
+	}
+	n := int64(numConnections.Load())
+	saturation = float64(n) / float64(shedLimit)
+	if shedThreshold > 0 && n > shedThreshold {
+		shedFraction = min(float64(n-shedThreshold)/float64(max(shedLimit-shedThreshold, 1)), 1)
+	}
+	return saturation, shedFraction
+}
+
+// probePaths are polled by Kubernetes probes and load balancer health checks
+// rather than requested by clients.
+var probePaths = []string{"/ready", "/startup", "/drain-ready"}
+
+// withLoadShedding degrades gracefully under connection pressure by rejecting
+// the fraction of requests given by connSaturation with 503 and "Connection:
+// close", so that clients back off and release connections. /metrics and
+// /saturation are never shed, to keep the pressure observable, and neither are
+// probes, whose failure would get the server restarted or taken out of
+// rotation and the remaining instances even more overloaded.
+func withLoadShedding(next http.Handler) http.Handler {
+	if shedThreshold <= 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/metrics" || r.URL.Path == "/saturation" || slices.Contains(probePaths, r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if _, shedFraction := connSaturation(); rand.Float64() < shedFraction {
+			shedRequests.Add(1)
+			w.Header().Set("Connection", "close")
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "Overloaded, shedding load\n", http.StatusServiceUnavailable)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// saturationReport reports the current connection saturation and how much
+// load is being shed.
+func saturationReport(w http.ResponseWriter) {
+	saturation, shedFraction := connSaturation()
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"connections":  numConnections.Load(),
+		"threshold":    shedThreshold,
+		"limit":        shedLimit,
+		"saturation":   saturation,
+		"shedFraction": shedFraction,
+		"shedRequests": shedRequests.Load(),
+	})
+}
+
+// withRequestLimit recycles the server after it served maxTotalRequests requests
+// by responding with "Connection: close" from then on and initiating shutdown.
+func withRequestLimit(next http.Handler) http.Handler {
+	if maxTotalRequests <= 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if n := totalRequests.Add(1); n >= maxTotalRequests {
+			w.Header().Set("Connection", "close")
+			if n == maxTotalRequests {
+				_, _ = fmt.Printf("%v: served %d requests, recycling server\n", time.Now().Format(time.RFC3339), n)
+				requestShutdown()
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requestCounts counts the requests per route pattern and response status.
+var requestCounts = struct {
+	mu     sync.Mutex
+	counts map[requestCountKey]int64
+}{counts: make(map[requestCountKey]int64)}
+
+type requestCountKey struct {
+	pattern string
+	status  string
+}
+
+// statusRecorder counts the request in requestCounts with the status of the
+// response once it is written.
+type statusRecorder struct {
+	http.ResponseWriter
+	pattern string
+	counted bool
+}
+
+func (w *statusRecorder) count(status string) {
+	if w.counted {
+		return
+	}
+	w.counted = true
+	requestCounts.mu.Lock()
+	requestCounts.counts[requestCountKey{pattern: w.pattern, status: status}]++
+	requestCounts.mu.Unlock()
+}
+
+func (w *statusRecorder) WriteHeader(code int) {
+	if !isInformational(code) {
+		w.count(strconv.Itoa(code))
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusRecorder) Write(b []byte) (int, error) {
+	w.count("200")
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *statusRecorder) Flush() {
+	w.count("200")
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack counts the request before handing over the connection, as it gets no
+// regular response.
+func (w *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	w.count("hijacked")
+	return http.NewResponseController(w.ResponseWriter).Hijack()
+}
+
+func (w *statusRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *statusRecorder) ReadFrom(src io.Reader) (int64, error) {
+	w.count("200")
+	if rf, ok := w.ResponseWriter.(io.ReaderFrom); ok {
+		return rf.ReadFrom(src)
+	}
+	return io.Copy(w.ResponseWriter, src)
+}
+
+// withRequestMetrics counts the requests to pattern by response status for
+// /metrics.
+func withRequestMetrics(pattern string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sr := &statusRecorder{ResponseWriter: w, pattern: pattern}
+		next.ServeHTTP(sr, r)
+		// net/http sends 200 if nothing was written
+		sr.count("200")
+	})
+}
 
 func withLastModified(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -31,299 +599,4890 @@ func withLastModified(next http.Handler) http.Handler {
 	})
 }
 
-type connectionCloseWriter struct {
-	http.ResponseWriter
-	headerWritten bool
+// withCacheHeaders adds caching headers as requested by the query parameters
+// cache (verbatim Cache-Control value, e.g. cache=max-age=60), expires (a
+// duration from now) and etag=true. The latter buffers the whole response of
+// GET requests to derive a strong ETag from its content and answers 200
+// responses with 304 Not Modified if it matches If-None-Match. It wraps
+// withCompression, so that every content coding gets its own ETag. Without
+// these parameters responses carry no caching headers.
+func withCacheHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if cc := q.Get("cache"); cc != "" {
+			w.Header().Set("Cache-Control", cc)
+		}
+		if expiresStr := q.Get("expires"); expiresStr != "" {
+			expires, err := time.ParseDuration(expiresStr)
+			if err != nil {
+				http.Error(w, "Invalid expires parameter\n", http.StatusBadRequest)
+				return
+			}
+			w.Header().Set("Expires", time.Now().Add(expires).UTC().Format(http.TimeFormat))
+		}
+		if q.Get("etag") != "true" || r.Method != http.MethodGet {
+			next.ServeHTTP(w, r)
+			return
+		}
+		cw := &etagWriter{ResponseWriter: w}
+		next.ServeHTTP(cw, r)
+		cw.finish(r)
+	})
 }
 
-func (w *connectionCloseWriter) injectHeader() {
-	if !w.headerWritten {
-		w.headerWritten = true
-		if shutdownInitiated.Load() {
-			w.ResponseWriter.Header().Set("Connection", "close")
+// compressors create the encoders of the supported content codings.
+var compressors = map[string]func(w io.Writer, level int) (compressor, error){
+	"gzip": func(w io.Writer, level int) (compressor, error) {
+		return gzip.NewWriterLevel(w, level)
+	},
+	// the "deflate" coding is a zlib stream (RFC 9110, 8.4.1.2), not raw DEFLATE
+	"deflate": func(w io.Writer, level int) (compressor, error) {
+		return zlib.NewWriterLevel(w, level)
+	},
+}
+
+type compressor interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// acceptEncodingQuality returns the quality value that the Accept-Encoding
+// header values give the content coding, which is 0 if it is not acceptable.
+func acceptEncodingQuality(acceptEncoding []string, coding string) float64 {
+	q, wildcardQ, explicit := 0.0, 0.0, false
+	for _, v := range acceptEncoding {
+		for c := range strings.SplitSeq(v, ",") {
+			name, params, _ := strings.Cut(c, ";")
+			name = strings.ToLower(strings.TrimSpace(name))
+			if name == "x-gzip" {
+				name = "gzip"
+			}
+			rangeQ := 1.0
+			if param, value, ok := strings.Cut(strings.TrimSpace(params), "="); ok && strings.EqualFold(strings.TrimSpace(param), "q") {
+				if parsed, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err == nil {
+					rangeQ = parsed
+				}
+			}
+			switch name {
+			case coding:
+				q, explicit = rangeQ, true
+			case "*":
+				wildcardQ = rangeQ
+			}
 		}
 	}
+	if explicit {
+		return q
+	}
+	return wildcardQ
 }
 
-func (w *connectionCloseWriter) WriteHeader(code int) {
-	w.injectHeader()
+// withCompression compresses responses with the best of the COMPRESSION
+// algorithms (gzip and deflate are supported) that the client accepts, at
+// COMPRESSION_LEVEL. The first configured algorithm wins ties.
+func withCompression(next http.Handler) http.Handler {
+	if len(compressionAlgorithms) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		coding, bestQ := "", 0.0
+		for _, algorithm := range compressionAlgorithms {
+			if q := acceptEncodingQuality(r.Header.Values("Accept-Encoding"), algorithm); q > bestQ {
+				coding, bestQ = algorithm, q
+			}
+		}
+		if coding == "" || r.Method == http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+		cw := &compressWriter{ResponseWriter: w, coding: coding}
+		defer cw.close()
+		next.ServeHTTP(cw, r)
+	})
+}
+
+// compressWriter compresses the response body, unless the status code does
+// not allow a body, the handler already encoded it or it set a Content-Length
+// to frame the response exactly, like /bytes, /sized and /boundary do.
+type compressWriter struct {
+	http.ResponseWriter
+	coding      string
+	enc         compressor
+	wroteHeader bool
+}
+
+func (w *compressWriter) WriteHeader(code int) {
+	if isInformational(code) {
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	if code >= 200 && code != http.StatusNoContent && code != http.StatusNotModified && w.Header().Get("Content-Encoding") == "" && w.Header().Get("Content-Length") == "" {
+		enc, err := compressors[w.coding](w.ResponseWriter, int(compressionLevel))
+		if err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "%v: failed to create %v encoder: %v\n", time.Now().Format(time.RFC3339), w.coding, err)
+		} else {
+			w.enc = enc
+			w.Header().Set("Content-Encoding", w.coding)
+		}
+	}
 	w.ResponseWriter.WriteHeader(code)
 }
 
-func (w *connectionCloseWriter) Write(b []byte) (int, error) {
-	// Write implicitly sends a 200 WriteHeader if not yet called,
-	// so we inject before that happens.
-	w.injectHeader()
-	return w.ResponseWriter.Write(b)
+func (w *compressWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.enc == nil {
+		return w.ResponseWriter.Write(b)
+	}
+	return w.enc.Write(b)
+}
+
+func (w *compressWriter) Flush() {
+	if w.enc != nil {
+		_ = w.enc.Flush()
+	}
+	_ = http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+func (w *compressWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *compressWriter) close() {
+	if w.enc != nil {
+		_ = w.enc.Close()
+	}
+}
+
+// etagWriter buffers a response until finish, so that its ETag can be sent
+// in the header. Flushing gives up on the ETag and streams the response
+// instead.
+type etagWriter struct {
+	http.ResponseWriter
+	code      int
+	body      bytes.Buffer
+	streaming bool
+}
+
+func (w *etagWriter) WriteHeader(code int) {
+	if isInformational(code) {
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
+	if w.code == 0 {
+		w.code = code
+	}
+}
+
+func (w *etagWriter) Write(b []byte) (int, error) {
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	if w.streaming {
+		return w.ResponseWriter.Write(b)
+	}
+	return w.body.Write(b)
+}
+
+func (w *etagWriter) Flush() {
+	if !w.streaming {
+		w.streaming = true
+		if w.code == 0 {
+			w.code = http.StatusOK
+		}
+		w.ResponseWriter.WriteHeader(w.code)
+		_, _ = w.ResponseWriter.Write(w.body.Bytes())
+		w.body.Reset()
+	}
+	_ = http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// Unwrap allows http.ResponseController to reach the underlying ResponseWriter,
+// e.g. for setting deadlines or hijacking the connection.
+func (w *etagWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *etagWriter) finish(r *http.Request) {
+	if w.streaming {
+		return
+	}
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	if w.code >= 200 && w.code < 300 {
+		sum := sha256.Sum256(w.body.Bytes())
+		etag := fmt.Sprintf(`"%x"`, sum[:16])
+		w.Header().Set("ETag", etag)
+		if w.code == http.StatusOK && etagMatches(r.Header.Get("If-None-Match"), etag) {
+			w.Header().Del("Content-Length")
+			w.ResponseWriter.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(w.body.Len()))
+	w.ResponseWriter.WriteHeader(w.code)
+	_, _ = w.ResponseWriter.Write(w.body.Bytes())
+}
+
+// etagMatches reports whether the If-None-Match header value matches etag
+// using the weak comparison required for If-None-Match.
+func etagMatches(ifNoneMatch, etag string) bool {
+	for candidate := range strings.SplitSeq(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// isInformational reports whether code is a 1xx response that is followed by
+// the final response on the same connection.
+func isInformational(code int) bool {
+	return code >= 100 && code < 200 && code != http.StatusSwitchingProtocols
+}
+
+// dropCloseHeader decides whether to simulate a buggy server that forgets to
+// send "Connection: close" during shutdown. Only with FAULT_INJECTION=true.
+func dropCloseHeader() bool {
+	return faultInjection && rand.Float64() < dropCloseHeaderRate
+}
+
+type connectionCloseWriter struct {
+	http.ResponseWriter
+	headerWritten bool
+	// forceClose injects Connection: close even if not shutting down
+	forceClose bool
+}
+
+func (w *connectionCloseWriter) injectHeader() {
+	if !w.headerWritten {
+		w.headerWritten = true
+		if w.forceClose || shutdownInitiated.Load() && !dropCloseHeader() {
+			w.ResponseWriter.Header().Set("Connection", "close")
+		}
+	}
+}
+
+func (w *connectionCloseWriter) WriteHeader(code int) {
+	if isInformational(code) {
+		// the actual response is still to come
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
+	w.injectHeader()
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *connectionCloseWriter) Write(b []byte) (int, error) {
+	// Write implicitly sends a 200 WriteHeader if not yet called,
+	// so we inject before that happens.
+	w.injectHeader()
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *connectionCloseWriter) Flush() {
+	// flushing sends the headers as well
+	w.injectHeader()
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap allows http.ResponseController to reach the underlying ResponseWriter,
+// e.g. for hijacking the connection.
+func (w *connectionCloseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *connectionCloseWriter) ReadFrom(src io.Reader) (int64, error) {
+	w.injectHeader()
+	if rf, ok := w.ResponseWriter.(io.ReaderFrom); ok {
+		return rf.ReadFrom(src)
+	}
+	// Fallback: copy manually via Write (which won't re-inject thanks to the guard).
+	return io.Copy(w.ResponseWriter, src)
+}
+
+// keepAliveHeaderWriter advertises the server's connection reuse policy via a
+// "Keep-Alive: timeout=N, max=M" header unless the connection is going to be
+// closed after the response anyway.
+type keepAliveHeaderWriter struct {
+	http.ResponseWriter
+	headerWritten bool
+	// maxRequests is advertised as max, i.e. the number of requests the
+	// client may still send on the connection
+	maxRequests int64
+}
+
+func (w *keepAliveHeaderWriter) injectHeader() {
+	if w.headerWritten {
+		return
+	}
+	w.headerWritten = true
+	h := w.ResponseWriter.Header()
+	if strings.EqualFold(h.Get("Connection"), "close") || (gracefulShutdown && shutdownInitiated.Load()) {
+		h.Del("Keep-Alive")
+		return
+	}
+	var params []string
+	if keepAliveHeaderTimeout > 0 {
+		params = append(params, fmt.Sprintf("timeout=%d", int(keepAliveHeaderTimeout.Seconds())))
+	}
+	if w.maxRequests > 0 {
+		params = append(params, fmt.Sprintf("max=%d", w.maxRequests))
+	}
+	h.Set("Keep-Alive", strings.Join(params, ", "))
+}
+
+func (w *keepAliveHeaderWriter) WriteHeader(code int) {
+	if isInformational(code) {
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
+	w.injectHeader()
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *keepAliveHeaderWriter) Write(b []byte) (int, error) {
+	w.injectHeader()
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *keepAliveHeaderWriter) Flush() {
+	w.injectHeader()
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *keepAliveHeaderWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *keepAliveHeaderWriter) ReadFrom(src io.Reader) (int64, error) {
+	w.injectHeader()
+	if rf, ok := w.ResponseWriter.(io.ReaderFrom); ok {
+		return rf.ReadFrom(src)
+	}
+	return io.Copy(w.ResponseWriter, src)
+}
+
+func withKeepAliveHeader(next http.Handler) http.Handler {
+	if keepAliveHeaderTimeout <= 0 && keepAliveHeaderMax <= 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 1 || r.Close {
+			// Keep-Alive is a connection-specific header that HTTP/2 forbids and
+			// pointless if the client is going to close the connection
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !keepAliveEnforceMax || keepAliveHeaderMax <= 0 {
+			next.ServeHTTP(&keepAliveHeaderWriter{ResponseWriter: w, maxRequests: keepAliveHeaderMax}, r)
+			return
+		}
+		// Enforce the advertised max like Apache's MaxKeepAliveRequests: max
+		// counts down the requests left on the connection and the last one is
+		// answered with "Connection: close", which drops the Keep-Alive header.
+		remaining := keepAliveHeaderMax - connInfoFrom(r.Context()).requests.Load()
+		var rw http.ResponseWriter = &keepAliveHeaderWriter{ResponseWriter: w, maxRequests: remaining}
+		if remaining <= 0 {
+			rw = &connectionCloseWriter{ResponseWriter: rw, forceClose: true}
+		}
+		next.ServeHTTP(rw, r)
+	})
+}
+
+// adminOnly restricts next to requests carrying "Authorization: Bearer <ADMIN_TOKEN>".
+// Admin endpoints are disabled altogether if ADMIN_TOKEN is not set.
+func adminOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if adminToken == "" {
+			http.Error(w, "Admin endpoints are disabled\n", http.StatusForbidden)
+			return
+		}
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+			http.Error(w, "Unauthorized\n", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// connInfo is tracked per connection from the moment it is accepted.
+type connInfo struct {
+	id       uint64
+	conn     net.Conn
+	accepted time.Time
+	requests atomic.Int64
+	// multiStatus counts the /multi-status requests served on the connection
+	multiStatus atomic.Int64
+	// lastRequestEnd is when the connection went idle in Unix nanoseconds, it
+	// is only tracked with CONN_RESET_AFTER_IDLE set
+	lastRequestEnd atomic.Int64
+	// timeline is only tracked with CONN_TIMELINE=true
+	timeline *connTimeline
+}
+
+type timelineEvent struct {
+	// At is the offset from when the connection was accepted
+	At     string `json:"at"`
+	Event  string `json:"event"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// connTimeline records what happened on a connection over its lifetime,
+// keeping at most CONN_TIMELINE_MAX_EVENTS events plus the final one.
+type connTimeline struct {
+	mu      sync.Mutex
+	events  []timelineEvent
+	dropped int
+}
+
+func (ci *connInfo) addTimelineEvent(event, detail string, final bool) {
+	t := ci.timeline
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !final && int64(len(t.events)) >= connTimelineMaxEvents {
+		t.dropped++
+		return
+	}
+	t.events = append(t.events, timelineEvent{
+		At:     time.Since(ci.accepted).Round(time.Microsecond).String(),
+		Event:  event,
+		Detail: detail,
+	})
+}
+
+type connInfoKey struct{}
+
+// lastConnID numbers the connections served.
+var lastConnID atomic.Uint64
+
+// withConnInfo is used as http.Server.ConnContext to attach a connInfo to the
+// context of every request served on the connection.
+func withConnInfo(ctx context.Context, c net.Conn) context.Context {
+	ci := &connInfo{id: lastConnID.Add(1), conn: c, accepted: time.Now()}
+	if connTimelines {
+		ci.timeline = &connTimeline{}
+		ci.addTimelineEvent("accept", c.RemoteAddr().String(), false)
+	}
+	if cc, ok := underlyingConn[*countingConn](c); ok {
+		cc.info.Store(ci)
+	}
+	return context.WithValue(ctx, connInfoKey{}, ci)
+}
+
+// connInfoFrom returns the connInfo of the connection the request was served on.
+func connInfoFrom(ctx context.Context) *connInfo {
+	if ci, ok := ctx.Value(connInfoKey{}).(*connInfo); ok {
+		return ci
+	}
+	// not served by a server using withConnInfo as ConnContext
+	return &connInfo{accepted: time.Now()}
+}
+
+// keepAliveIntent describes whether the client asked for the connection to be
+// kept alive, either explicitly or by default of the protocol version.
+func keepAliveIntent(r *http.Request) string {
+	switch {
+	case r.ProtoMajor >= 2:
+		return "multiplexed"
+	case httpHeaderHasToken(r.Header, "Connection", "close"):
+		return "close"
+	case httpHeaderHasToken(r.Header, "Connection", "keep-alive"):
+		return "keep-alive"
+	case r.ProtoAtLeast(1, 1):
+		return "keep-alive (default)"
+	default:
+		return "close (default)"
+	}
+}
+
+// httpHeaderHasToken reports whether the comma-separated header name contains token.
+func httpHeaderHasToken(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// lastRequest is when a request was last seen, in Unix nanoseconds.
+var lastRequest atomic.Int64
+
+// countsAsActivity reports whether a request to path keeps the server from
+// shutting down when idle. Probes, metrics scrapes and admin requests keep
+// coming in while there is no traffic, so they don't.
+func countsAsActivity(path string) bool {
+	return !slices.Contains(probePaths, path) && path != "/metrics" && path != "/saturation" && !strings.HasPrefix(path, "/admin/")
+}
+
+// withConnTracking counts the requests per connection and, with VERBOSE=true,
+// logs the client's keep-alive intent and whether the connection was reused.
+// With CONN_DEBUG_HEADERS=true, the request count and age of the connection
+// are returned in the X-Conn-Requests and X-Conn-Age response headers. The
+// first request on a connection is delayed by FIRST_REQUEST_DELAY and, with
+// FIRST_REQUEST_HEADER=true, marked with X-Conn-Warm-Up.
+func withConnTracking(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if countsAsActivity(r.URL.Path) {
+			lastRequest.Store(time.Now().UnixNano())
+			defer func() {
+				lastRequest.Store(time.Now().UnixNano())
+			}()
+		}
+		ci := connInfoFrom(r.Context())
+		if connResetAfterIdle > 0 {
+			// treat a connection that was idle for long as a new one
+			if last := ci.lastRequestEnd.Load(); last != 0 && time.Since(time.Unix(0, last)) >= connResetAfterIdle {
+				ci.requests.Store(0)
+				ci.multiStatus.Store(0)
+				if verbose {
+					_, _ = fmt.Printf("%v: connection from %v was idle for %v, resetting its state\n", time.Now().Format(time.RFC3339),
+						r.RemoteAddr, time.Since(time.Unix(0, last)).Round(time.Millisecond))
+				}
+			}
+			defer func() {
+				ci.lastRequestEnd.Store(time.Now().UnixNano())
+			}()
+		}
+		n := ci.requests.Add(1)
+		ci.addTimelineEvent("request start", r.Method+" "+r.URL.Path, false)
+		defer ci.addTimelineEvent("request end", r.Method+" "+r.URL.Path, false)
+		if n == 1 && ci.lastRequestEnd.Load() == 0 {
+			acceptStats.record(time.Since(ci.accepted))
+		}
+		if n == 1 && firstRequestHeader {
+			w.Header().Set("X-Conn-Warm-Up", "true")
+		}
+		if n == 1 && firstRequestDelay > 0 {
+			// model the setup a new connection needs before it is usable,
+			// which keep-alive pays only once per connection
+			select {
+			case <-time.After(firstRequestDelay):
+			case <-r.Context().Done():
+				return
+			}
+		}
+		if connDebugHeaders {
+			w.Header().Set("X-Conn-Requests", strconv.FormatInt(n, 10))
+			w.Header().Set("X-Conn-Age", time.Since(ci.accepted).Round(time.Millisecond).String())
+		}
+		if verbose {
+			reuse := "new connection"
+			if n > 1 {
+				reuse = "reused connection"
+			}
+			_, _ = fmt.Printf("%v: %v %v from %v (%v): keep-alive intent %v, request #%d on %v\n", time.Now().Format(time.RFC3339),
+				r.Method, r.URL.Path, r.RemoteAddr, r.Proto, keepAliveIntent(r), n, reuse)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// routeMaxRequestDuration returns the maximum request duration for path from
+// ROUTE_MAX_REQUEST_DURATION ("/prefix=duration,..."), where the longest
+// matching route prefix wins and 0 exempts a route, or MAX_REQUEST_DURATION
+// if no route prefix matches.
+func routeMaxRequestDuration(path string) time.Duration {
+	d, longest := maxRequestDuration, -1
+	for prefix, routeD := range routeRequestDurations {
+		if strings.HasPrefix(path, prefix) && len(prefix) > longest {
+			d, longest = routeD, len(prefix)
+		}
+	}
+	return d
+}
+
+// withMaxRequestDuration enforces the routeMaxRequestDuration as a write
+// deadline on the connection of HTTP/1 requests, so that a request that takes
+// longer fails to write its response and net/http closes the connection.
+// Unlike a handler timeout, the client gets no response at all. HTTP/2
+// connections are shared by concurrent requests and therefore left alone.
+func withMaxRequestDuration(next http.Handler) http.Handler {
+	if maxRequestDuration <= 0 && len(routeRequestDurations) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn := connInfoFrom(r.Context()).conn
+		maxDuration := routeMaxRequestDuration(r.URL.Path)
+		if conn == nil || r.ProtoMajor != 1 || maxDuration <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		deadline := time.Now().Add(maxDuration)
+		_ = conn.SetWriteDeadline(deadline)
+		next.ServeHTTP(w, r)
+		if time.Now().Before(deadline) {
+			// let the response be flushed and the next request on this
+			// connection start without a deadline
+			_ = conn.SetWriteDeadline(time.Time{})
+		} else {
+			_, _ = fmt.Printf("%v: %v %v from %v exceeded %v, closing connection\n", time.Now().Format(time.RFC3339), r.Method, r.URL.Path, r.RemoteAddr, maxDuration)
+		}
+	})
+}
+
+// instanceID identifies this server instance in affinity cookies.
+var instanceID = sync.OnceValue(func() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	return fmt.Sprintf("%v-%x", hostname, startTime.UnixNano())
+})
+
+// withAffinity sets the AFFINITY_COOKIE to identify this instance and the
+// connection on first contact, and reports in the X-Affinity header whether
+// the client came back on the same connection, on another connection to the
+// same instance, or to another instance, in which case the cookie is renewed.
+func withAffinity(next http.Handler) http.Handler {
+	if affinityCookie == "" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn := strconv.FormatUint(connInfoFrom(r.Context()).id, 10)
+		affinity := "new"
+		if c, err := r.Cookie(affinityCookie); err == nil {
+			// the connection ID is numeric, but the hostname may contain dots
+			instance, cookieConn := c.Value, ""
+			if i := strings.LastIndex(c.Value, "."); i >= 0 {
+				instance, cookieConn = c.Value[:i], c.Value[i+1:]
+			}
+			switch {
+			case instance != instanceID():
+				affinity = "other-instance"
+			case cookieConn == conn:
+				affinity = "same-connection"
+			default:
+				affinity = "same-instance"
+			}
+		}
+		if affinity == "new" || affinity == "other-instance" {
+			c := &http.Cookie{Name: affinityCookie, Value: instanceID() + "." + conn, Path: "/", HttpOnly: true}
+			if affinityCookieTTL > 0 {
+				c.MaxAge = int(affinityCookieTTL.Seconds())
+			}
+			http.SetCookie(w, c)
+		}
+		w.Header().Set("X-Affinity", affinity)
+		if verbose {
+			_, _ = fmt.Printf("%v: %v %v from %v: affinity %v\n", time.Now().Format(time.RFC3339), r.Method, r.URL.Path, r.RemoteAddr, affinity)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// inFlightRequest is a request that is currently being handled.
+type inFlightRequest struct {
+	method   string
+	path     string
+	start    time.Time
+	reported bool
+}
+
+// inFlight tracks all requests that are currently being handled.
+var inFlight = struct {
+	mu       sync.Mutex
+	nextID   uint64
+	requests map[uint64]*inFlightRequest
+}{requests: make(map[uint64]*inFlightRequest)}
+
+func withInFlightTracking(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		inFlight.mu.Lock()
+		inFlight.nextID++
+		id := inFlight.nextID
+		start := time.Now()
+		inFlight.requests[id] = &inFlightRequest{method: r.Method, path: r.URL.Path, start: start}
+		inFlight.mu.Unlock()
+		defer func() {
+			requestStats.record(time.Since(start))
+			inFlight.mu.Lock()
+			delete(inFlight.requests, id)
+			inFlight.mu.Unlock()
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// logSlowestInFlight logs the n longest-running in-flight requests, which are
+// the ones holding up a drain.
+func logSlowestInFlight(n int) {
+	inFlight.mu.Lock()
+	requests := make([]inFlightRequest, 0, len(inFlight.requests))
+	for _, req := range inFlight.requests {
+		requests = append(requests, *req)
+	}
+	inFlight.mu.Unlock()
+	slices.SortFunc(requests, func(a, b inFlightRequest) int {
+		return a.start.Compare(b.start)
+	})
+	for _, req := range requests[:min(n, len(requests))] {
+		_, _ = fmt.Printf("%v:   in flight for %v: %v %v\n", time.Now().Format(time.RFC3339), time.Since(req.start), req.method, req.path)
+	}
+}
+
+// watchdog logs every request that has been in flight for longer than
+// watchdogThreshold once and optionally dumps all goroutines to help
+// diagnose where it is stuck.
+func watchdog() {
+	interval := max(watchdogThreshold/2, 100*time.Millisecond)
+	for range time.Tick(interval) {
+		var stuck int
+		inFlight.mu.Lock()
+		for _, req := range inFlight.requests {
+			if age := time.Since(req.start); age > watchdogThreshold && !req.reported {
+				req.reported = true
+				stuck++
+				_, _ = fmt.Fprintf(os.Stderr, "%v: watchdog: %v %v in flight for %v\n", time.Now().Format(time.RFC3339), req.method, req.path, age)
+			}
+		}
+		inFlight.mu.Unlock()
+		if stuck > 0 && watchdogGoroutineDump {
+			_ = pprof.Lookup("goroutine").WriteTo(os.Stderr, 2)
+		}
+	}
+}
+
+// sensitiveConfig reports whether the value of the environment variable name
+// must not be revealed.
+func sensitiveConfig(name string) bool {
+	for _, s := range []string{"TOKEN", "SECRET", "PASSWORD", "KEY"} {
+		if strings.Contains(name, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// adminEnv returns the effective value of every recognized environment
+// variable, as a shell script that can be sourced to reproduce the
+// configuration or as JSON with format=json. Sensitive values are redacted.
+func adminEnv(w http.ResponseWriter, r *http.Request) {
+	values := make(map[string]string, len(configValues))
+	for name, v := range configValues {
+		if sensitiveConfig(name) && v != "" {
+			v = "REDACTED"
+		}
+		values[name] = v
+	}
+	if r.URL.Query().Get("format") == "json" || negotiate(r, "text/x-shellscript", "application/json") == "application/json" {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(values)
+		return
+	}
+	w.Header().Set("Content-Type", "text/x-shellscript; charset=utf-8")
+	for _, name := range slices.Sorted(maps.Keys(values)) {
+		_, _ = fmt.Fprintf(w, "export %v='%v'\n", name, strings.ReplaceAll(values[name], "'", `'\''`))
+	}
+}
+
+// selfConns holds the long-lived connections opened by /admin/self-connections.
+var selfConns = struct {
+	mu     sync.Mutex
+	ctx    context.Context
+	cancel context.CancelFunc
+	open   atomic.Int64
+}{}
+
+// selfConnections opens n long-lived connections to this server's
+// /sleep?forever=true, or closes all of them again with stop=true.
+func selfConnections(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("stop") == "true" {
+		stopSelfConnections()
+		_, _ = fmt.Fprintf(w, "Closed self connections\n")
+		return
+	}
+	n, err := strconv.Atoi(r.URL.Query().Get("n"))
+	if err != nil || n < 1 || n > 10000 {
+		http.Error(w, "Invalid n parameter\n", http.StatusBadRequest)
+		return
+	}
+	selfConns.mu.Lock()
+	if selfConns.ctx == nil {
+		selfConns.ctx, selfConns.cancel = context.WithCancel(context.Background())
+	}
+	ctx := selfConns.ctx
+	selfConns.mu.Unlock()
+	// a dedicated transport, so that every request gets its own connection
+	client := &http.Client{Transport: &http.Transport{}}
+	for range n {
+		go func() {
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, selfURL+"/sleep?forever=true", http.NoBody)
+			if err != nil {
+				return
+			}
+			selfConns.open.Add(1)
+			defer selfConns.open.Add(-1)
+			resp, err := client.Do(req)
+			if err != nil {
+				return
+			}
+			_, _ = io.Copy(io.Discard, resp.Body)
+			_ = resp.Body.Close()
+		}()
+	}
+	_, _ = fmt.Fprintf(w, "Opening %d self connections\n", n)
+}
+
+// stopSelfConnections closes all connections opened by /admin/self-connections.
+func stopSelfConnections() {
+	selfConns.mu.Lock()
+	defer selfConns.mu.Unlock()
+	if selfConns.cancel != nil {
+		_, _ = fmt.Printf("%v: closing %d self connections\n", time.Now().Format(time.RFC3339), selfConns.open.Load())
+		selfConns.cancel()
+		selfConns.ctx, selfConns.cancel = nil, nil
+	}
+}
+
+// stuckMu is held by /admin/deadlock to simulate handlers stuck on a lock.
+var stuckMu sync.Mutex
+
+// deadlock acquires stuckMu and holds it for the given duration, so that this
+// and all further calls pile up waiting for the lock.
+func deadlock(w http.ResponseWriter, r *http.Request) {
+	hold := time.Minute
+	if holdStr := r.URL.Query().Get("hold"); holdStr != "" {
+		var err error
+		if hold, err = time.ParseDuration(holdStr); err != nil {
+			http.Error(w, "Failed to parse hold duration\n", http.StatusBadRequest)
+			return
+		}
+	}
+	start := time.Now()
+	stuckMu.Lock()
+	defer stuckMu.Unlock()
+	time.Sleep(hold)
+	_, _ = fmt.Fprintf(w, "Held lock for %v after waiting %v\n", hold, time.Since(start)-hold)
+}
+
+func graceful(next http.Handler) http.Handler {
+	if !gracefulShutdown {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// "Connection: close" has no meaning in HTTP/2 (RFC 9113, 8.2.2), but
+		// net/http strips it from HTTP/2 responses and gracefully shuts down
+		// the connection with a GOAWAY instead, so it drains HTTP/2
+		// connections as well, even if keep-alives stay enabled.
+		cw := &connectionCloseWriter{
+			ResponseWriter: w,
+		}
+		next.ServeHTTP(cw, r)
+	})
+}
+
+func buildInverseDiscreteCDF[T any](values []T, probabilities []float32) func() T {
+	cdf := make([]float32, len(probabilities))
+	var cumProb float32 = 0.0
+	for i, p := range probabilities {
+		cumProb += p
+		cdf[i] = cumProb
+	}
+	return func() T {
+		r := rand.Float32()
+		for i, cp := range cdf {
+			if r <= cp {
+				return values[i]
+			}
+		}
+		return values[len(values)-1]
+	}
+}
+
+// parsePDF parses a discrete probability density function of the form
+// "duration1:probability1,duration2:probability2,..." and returns a sampler
+// for it. Probabilities are relative and normalized to sum up to 1.
+func parsePDF(pdf string) (func() time.Duration, error) {
+	return parseDiscretePDF(pdf, "duration", time.ParseDuration)
+}
+
+// parseSizePDF parses a discrete probability density function of response
+// sizes like parsePDF, e.g. "1KB:0.8,1MB:0.2".
+func parseSizePDF(pdf string) (func() int64, error) {
+	return parseDiscretePDF(pdf, "size", func(s string) (int64, error) {
+		size, err := parseByteSize(s)
+		if err == nil && size > maxBytes {
+			err = fmt.Errorf("size exceeds %d bytes: %v", maxBytes, s)
+		}
+		return size, err
+	})
+}
+
+// parseDiscretePDF parses a discrete probability density function of the form
+// "value1:probability1,value2:probability2,..." using parse for the values of
+// the given kind.
+func parseDiscretePDF[T any](pdf, kind string, parse func(string) (T, error)) (func() T, error) {
+	var values []T
+	var probabilities []float32
+	var totalProb float32 = 0.0
+	for _, pair := range strings.Split(pdf, ",") {
+		valueStr, probStr, ok := strings.Cut(pair, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid pdf pair: %v", pair)
+		}
+		value, err := parse(valueStr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %v in pdf: %w", kind, err)
+		}
+		var prob float32
+		if _, err = fmt.Sscanf(probStr, "%f", &prob); err != nil {
+			return nil, fmt.Errorf("failed to parse probability in pdf: %w", err)
+		}
+		values = append(values, value)
+		probabilities = append(probabilities, prob)
+		totalProb += prob
+	}
+	if totalProb <= 0.0 {
+		return nil, errors.New("total probability in pdf must be greater than 0")
+	}
+	invTotalProb := float32(1.0) / totalProb
+	for i := range probabilities {
+		probabilities[i] *= invTotalProb
+	}
+	return buildInverseDiscreteCDF(values, probabilities), nil
+}
+
+// periodicFlusher serializes writes to a ResponseWriter and flushes it every
+// interval in the background, so that streamed responses reach the client at a
+// consistent cadence regardless of how they are written. A non-positive
+// interval flushes after every write instead.
+type periodicFlusher struct {
+	mu       sync.Mutex
+	w        http.ResponseWriter
+	rc       *http.ResponseController
+	interval time.Duration
+	stop     chan struct{}
+	stopped  chan struct{}
+}
+
+func startPeriodicFlusher(ctx context.Context, w http.ResponseWriter, interval time.Duration) *periodicFlusher {
+	f := &periodicFlusher{
+		w:        w,
+		rc:       http.NewResponseController(w),
+		interval: interval,
+		stop:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+	if interval <= 0 {
+		close(f.stopped)
+		return f
+	}
+	go func() {
+		defer close(f.stopped)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				f.flush()
+			case <-f.stop:
+				return
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return f
+}
+
+func (f *periodicFlusher) flush() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_ = f.rc.Flush()
+}
+
+func (f *periodicFlusher) Write(b []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n, err := f.w.Write(b)
+	if err == nil && f.interval <= 0 {
+		err = f.rc.Flush()
+	}
+	return n, err
+}
+
+// Stop stops the background flushing and flushes whatever is still buffered.
+func (f *periodicFlusher) Stop() {
+	if f.interval > 0 {
+		close(f.stop)
+	}
+	<-f.stopped
+	f.flush()
+}
+
+// acceptQuality returns the quality value that the Accept header values give
+// the media type offer, taken from the most specific matching media range.
+func acceptQuality(accept []string, offer string) float64 {
+	if len(accept) == 0 {
+		return 1
+	}
+	offerType, _, _ := strings.Cut(offer, "/")
+	q, specificity := 0.0, 0
+	for _, v := range accept {
+		for mediaRange := range strings.SplitSeq(v, ",") {
+			mediaType, params, _ := strings.Cut(mediaRange, ";")
+			mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+			var s int
+			switch {
+			case mediaType == offer:
+				s = 3
+			case mediaType == offerType+"/*":
+				s = 2
+			case mediaType == "*/*":
+				s = 1
+			default:
+				continue
+			}
+			if s < specificity {
+				continue
+			}
+			rangeQ := 1.0
+			for param := range strings.SplitSeq(params, ";") {
+				if name, value, ok := strings.Cut(strings.TrimSpace(param), "="); ok && strings.EqualFold(name, "q") {
+					if parsed, err := strconv.ParseFloat(value, 64); err == nil {
+						rangeQ = parsed
+					}
+				}
+			}
+			q, specificity = rangeQ, s
+		}
+	}
+	return q
+}
+
+// negotiate returns the media type among offers that the Accept header of r
+// prefers. The first offer wins ties, so it is the default for requests
+// without Accept header or with "*/*", as well as if no offer is acceptable.
+func negotiate(r *http.Request, offers ...string) string {
+	best, bestQ := offers[0], 0.0
+	for _, offer := range offers {
+		if q := acceptQuality(r.Header.Values("Accept"), offer); q > bestQ {
+			best, bestQ = offer, q
+		}
+	}
+	return best
+}
+
+// writeNegotiated responds with code and either the text msg as plain text
+// or HTML, or data as JSON, as negotiated with the Accept header of r.
+func writeNegotiated(w http.ResponseWriter, r *http.Request, code int, msg string, data any) {
+	switch negotiate(r, "text/plain", "application/json", "text/html") {
+	case "application/json":
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		_ = json.NewEncoder(w).Encode(data)
+	case "text/html":
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(code)
+		_, _ = fmt.Fprintf(w, "<!DOCTYPE html>\n<html><body><p>%v</p></body></html>\n", html.EscapeString(strings.TrimSpace(msg)))
+	default:
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(code)
+		_, _ = io.WriteString(w, msg)
+	}
+}
+
+// maxChunks caps the number of chunks /sleep splits its sleep into.
+const maxChunks = 1000
+
+// sleepAndRespond sleeps for d, split into the given number of chunks of which
+// each is reported to the client as soon as it completes.
+func sleepAndRespond(w http.ResponseWriter, r *http.Request, d time.Duration, chunks int) {
+	if chunks <= 1 {
+		select {
+		case <-time.After(d):
+		case <-r.Context().Done():
+			return
+		}
+		writeNegotiated(w, r, http.StatusOK, fmt.Sprintf("Slept for %v\n", d), map[string]any{
+			"slept":        d.String(),
+			"sleptSeconds": d.Seconds(),
+		})
+		return
+	}
+	f := startPeriodicFlusher(r.Context(), w, flushInterval)
+	defer f.Stop()
+	chunk := d / time.Duration(chunks)
+	for i := 1; i <= chunks; i++ {
+		select {
+		case <-time.After(chunk):
+		case <-r.Context().Done():
+			return
+		}
+		_, _ = fmt.Fprintf(f, "Slept for chunk %d/%d (%v)\n", i, chunks, chunk)
+	}
+	_, _ = fmt.Fprintf(f, "Slept for %v\n", d)
+}
+
+// latencySampler draws the durations that /sleep sleeps for.
+type latencySampler interface {
+	Sample() time.Duration
+}
+
+// latencySamplerFunc adapts an inverse CDF to a latencySampler.
+type latencySamplerFunc func() time.Duration
+
+func (f latencySamplerFunc) Sample() time.Duration {
+	return f()
+}
+
+// uniformSampler samples uniformly from [lo, hi].
+type uniformSampler struct {
+	lo, hi time.Duration
+}
+
+func (s uniformSampler) Sample() time.Duration {
+	return s.lo + time.Duration(rand.Int63n(int64(s.hi-s.lo+1)))
+}
+
+// normalSampler samples from a normal distribution, clamping negative samples
+// to zero.
+type normalSampler struct {
+	mean, stddev time.Duration
+}
+
+func (s normalSampler) Sample() time.Duration {
+	return max(0, floatDuration(float64(s.mean)+float64(s.stddev)*rand.NormFloat64()))
+}
+
+// lognormalSampler samples e^X where X is normally distributed with mean mu
+// and standard deviation sigma.
+type lognormalSampler struct {
+	mu, sigma float64
+}
+
+func (s lognormalSampler) Sample() time.Duration {
+	return floatDuration(math.Exp(s.mu + s.sigma*rand.NormFloat64()))
+}
+
+// cappedSampler limits the samples of latencySampler to max.
+type cappedSampler struct {
+	latencySampler
+	max time.Duration
+}
+
+func (s cappedSampler) Sample() time.Duration {
+	return min(s.latencySampler.Sample(), s.max)
+}
+
+// floatDuration converts nanoseconds to a Duration, saturating instead of
+// overflowing for samples far out in the tail.
+func floatDuration(ns float64) time.Duration {
+	if ns >= math.MaxInt64 {
+		return math.MaxInt64
+	}
+	return time.Duration(ns)
+}
+
+// sleepSampleCap returns the longest sleep that the continuous distributions
+// may sample for path, which is MAX_SLEEP_SAMPLE or the route's maximum
+// request duration if that is shorter.
+func sleepSampleCap(path string) time.Duration {
+	limit := maxSleepSample
+	if d := routeMaxRequestDuration(path); d > 0 {
+		limit = min(limit, d)
+	}
+	return limit
+}
+
+// buildMomentSampler returns a sampler for a distribution parameterized by its
+// mean and standard deviation.
+func buildMomentSampler(dist string, mean, stddev time.Duration) (latencySampler, error) {
+	if stddev < 0 {
+		return nil, errors.New("stddev must not be negative")
+	}
+	switch dist {
+	case "normal":
+		return normalSampler{mean: mean, stddev: stddev}, nil
+	case "lognormal":
+		if mean <= 0 {
+			return nil, errors.New("mean must be positive")
+		}
+		// sigma^2 = ln(1 + stddev^2/mean^2) and mean = e^(mu + sigma^2/2)
+		variance := math.Log1p(math.Pow(float64(stddev)/float64(mean), 2))
+		return lognormalSampler{mu: math.Log(float64(mean)) - variance/2, sigma: math.Sqrt(variance)}, nil
+	default:
+		return nil, fmt.Errorf("unknown distribution: %v", dist)
+	}
+}
+
+// z-score of the 99th percentile of the standard normal distribution
+const z99 = 2.3263478740408408
+
+// buildInverseContinuousCDF returns a sampler for a long-tailed distribution
+// parameterized by its median (p50) and 99th percentile (p99).
+func buildInverseContinuousCDF(dist string, p50, p99 time.Duration) (latencySampler, error) {
+	if p50 <= 0 || p99 <= p50 {
+		return nil, errors.New("p50 must be positive and p99 must be greater than p50")
+	}
+	ratio := math.Log(float64(p99) / float64(p50))
+	switch dist {
+	case "pareto":
+		// Q(p) = xm * (1-p)^(-1/alpha), so p99/p50 = 50^(1/alpha)
+		alpha := math.Log(50) / ratio
+		xm := float64(p50) / math.Pow(2, 1/alpha)
+		return latencySamplerFunc(func() time.Duration {
+			return floatDuration(xm * math.Pow(1-rand.Float64(), -1/alpha))
+		}), nil
+	case "lognormal":
+		// median = e^mu and p99 = e^(mu + sigma*z99)
+		return lognormalSampler{mu: math.Log(float64(p50)), sigma: ratio / z99}, nil
+	default:
+		return nil, fmt.Errorf("unknown distribution: %v", dist)
+	}
+}
+
+func sleep(w http.ResponseWriter, r *http.Request) {
+	lo, hi := 50*time.Millisecond, 1*time.Second
+	minD, maxD := r.URL.Query().Get("min"), r.URL.Query().Get("max")
+	pdf := r.URL.Query().Get("pdf")
+	if r.URL.Query().Get("forever") == "true" {
+		// hold the connection until the client goes away
+		<-r.Context().Done()
+		return
+	}
+	chunks := 1
+	if chunksStr := r.URL.Query().Get("chunks"); chunksStr != "" {
+		var err error
+		if chunks, err = strconv.Atoi(chunksStr); err != nil || chunks < 1 || chunks > maxChunks {
+			http.Error(w, "Invalid chunks parameter\n", http.StatusBadRequest)
+			return
+		}
+	}
+	var sampler latencySampler
+	switch dist := r.URL.Query().Get("dist"); {
+	case dist == "normal" || dist == "lognormal" && r.URL.Query().Has("mean"):
+		mean, err := time.ParseDuration(r.URL.Query().Get("mean"))
+		if err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "%v: failed to parse mean: %v\n", time.Now().Format(time.RFC3339), err)
+			http.Error(w, "Failed to parse mean duration\n", http.StatusBadRequest)
+			return
+		}
+		stddev, err := time.ParseDuration(r.URL.Query().Get("stddev"))
+		if err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "%v: failed to parse stddev: %v\n", time.Now().Format(time.RFC3339), err)
+			http.Error(w, "Failed to parse stddev duration\n", http.StatusBadRequest)
+			return
+		}
+		if sampler, err = buildMomentSampler(dist, mean, stddev); err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "%v: invalid distribution: %v\n", time.Now().Format(time.RFC3339), err)
+			http.Error(w, "Invalid distribution parameters: "+err.Error()+"\n", http.StatusBadRequest)
+			return
+		}
+		sampler = cappedSampler{latencySampler: sampler, max: sleepSampleCap(r.URL.Path)}
+	case dist != "":
+		p50, err := time.ParseDuration(r.URL.Query().Get("p50"))
+		if err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "%v: failed to parse p50: %v\n", time.Now().Format(time.RFC3339), err)
+			http.Error(w, "Failed to parse p50 duration\n", http.StatusBadRequest)
+			return
+		}
+		p99, err := time.ParseDuration(r.URL.Query().Get("p99"))
+		if err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "%v: failed to parse p99: %v\n", time.Now().Format(time.RFC3339), err)
+			http.Error(w, "Failed to parse p99 duration\n", http.StatusBadRequest)
+			return
+		}
+		if sampler, err = buildInverseContinuousCDF(dist, p50, p99); err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "%v: invalid distribution: %v\n", time.Now().Format(time.RFC3339), err)
+			http.Error(w, "Invalid distribution parameters\n", http.StatusBadRequest)
+			return
+		}
+		sampler = cappedSampler{latencySampler: sampler, max: sleepSampleCap(r.URL.Path)}
+	case pdf != "":
+		inverseCDF, err := parsePDF(pdf)
+		if err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "%v: invalid pdf: %v\n", time.Now().Format(time.RFC3339), err)
+			http.Error(w, "Invalid pdf parameter: "+err.Error()+"\n", http.StatusBadRequest)
+			return
+		}
+		sampler = latencySamplerFunc(inverseCDF)
+	default:
+		if d, err := time.ParseDuration(minD); err == nil {
+			lo = d
+		} else if minD != "" {
+			_, _ = fmt.Fprintf(os.Stderr, "%v: NewRequest err: %v\n", time.Now().Format(time.RFC3339), err)
+			http.Error(w, "Failed to parse min duration\n", http.StatusBadRequest)
+			return
+		}
+		if d, err := time.ParseDuration(maxD); err == nil {
+			hi = d
+		} else if maxD != "" {
+			_, _ = fmt.Fprintf(os.Stderr, "%v: NewRequest err: %v\n", time.Now().Format(time.RFC3339), err)
+			http.Error(w, "Failed to parse max duration\n", http.StatusBadRequest)
+			return
+		}
+		sampler = uniformSampler{lo: lo, hi: hi}
+	}
+	perConn := sleepPerConnection
+	if perConnStr := r.URL.Query().Get("per_conn"); perConnStr != "" {
+		var err error
+		if perConn, err = time.ParseDuration(perConnStr); err != nil || perConn < 0 {
+			http.Error(w, "Invalid per_conn parameter\n", http.StatusBadRequest)
+			return
+		}
+	}
+	// the more connections are open, the longer every request takes, but at
+	// most as long as a sample of the continuous distributions
+	contention := min(floatDuration(float64(perConn)*float64(numConnections.Load())), sleepSampleCap(r.URL.Path))
+	d := sampler.Sample()
+	if d > math.MaxInt64-contention {
+		d = math.MaxInt64
+	} else {
+		d += contention
+	}
+	sleepAndRespond(w, r, d, chunks)
+}
+
+// hopByHopHeaders only apply to a single connection and must not be forwarded
+// by proxies, see RFC 9110, section 7.6.1.
+var hopByHopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Connection",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// copyEndToEndHeaders adds all headers of src to dest except for the
+// hop-by-hop headers, including those listed in the Connection header.
+func copyEndToEndHeaders(src, dest http.Header) {
+	skip := slices.Clone(hopByHopHeaders)
+	for _, v := range src.Values("Connection") {
+		for token := range strings.SplitSeq(v, ",") {
+			skip = append(skip, http.CanonicalHeaderKey(strings.TrimSpace(token)))
+		}
+	}
+	for name, values := range src {
+		if slices.Contains(skip, name) {
+			continue
+		}
+		for _, v := range values {
+			dest.Add(name, v)
+		}
+	}
+}
+
+// setForwardedHeaders tells the upstream where the request r came from by
+// appending the client IP to X-Forwarded-For, keeping the addresses of earlier
+// proxies, and setting X-Forwarded-Proto and X-Forwarded-Host.
+func setForwardedHeaders(r *http.Request, dest http.Header) {
+	clientIP, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		clientIP = r.RemoteAddr
+	}
+	if prior := r.Header.Values("X-Forwarded-For"); len(prior) > 0 {
+		clientIP = strings.Join(prior, ", ") + ", " + clientIP
+	}
+	dest.Set("X-Forwarded-For", clientIP)
+	proto := "http"
+	if r.TLS != nil {
+		proto = "https"
+	}
+	dest.Set("X-Forwarded-Proto", proto)
+	if r.Host != "" {
+		dest.Set("X-Forwarded-Host", r.Host)
+	}
+}
+
+func forwardTraceHeaders(src, dest http.Header) {
+	traceHeaders := []string{
+		"X-Request-ID",
+		"X-B3-Traceid",
+		"X-B3-Spanid",
+		"X-B3-Parentspanid",
+		"X-B3-Sampled",
+		"X-B3-Flags",
+		"X-Ot-Span-Context",
+		"Traceparent",
+		"Tracestate",
+		"B3",
+	}
+	for _, h := range traceHeaders {
+		if v := src.Get(h); v != "" {
+			dest.Set(h, v)
+		}
+	}
+}
+
+// latencyBuckets is the number of exponential latency histogram buckets, the
+// first covering up to 1ms and the last one everything above ~16s.
+const latencyBuckets = 16
+
+// latencyStats accumulates request latencies using only atomic operations.
+type latencyStats struct {
+	count   atomic.Int64
+	sum     atomic.Int64
+	errors  atomic.Int64
+	min     atomic.Int64
+	max     atomic.Int64
+	buckets [latencyBuckets]atomic.Int64
+}
+
+// proxyStats holds the latencyStats per backend. It is populated before the
+// server starts and only read afterward.
+var proxyStats = make(map[string]*latencyStats)
+
+// requestStats holds the latencyStats of all requests served.
+var requestStats = newLatencyStats()
+
+// acceptStats holds the latencyStats from accepting connections to their first request.
+var acceptStats = newLatencyStats()
+
+func newLatencyStats() *latencyStats {
+	s := &latencyStats{}
+	s.min.Store(math.MaxInt64)
+	return s
+}
+
+func (s *latencyStats) record(d time.Duration) {
+	s.count.Add(1)
+	s.sum.Add(int64(d))
+	for cur := s.min.Load(); int64(d) < cur && !s.min.CompareAndSwap(cur, int64(d)); cur = s.min.Load() {
+	}
+	for cur := s.max.Load(); int64(d) > cur && !s.max.CompareAndSwap(cur, int64(d)); cur = s.max.Load() {
+	}
+	i := 0
+	for bound := time.Millisecond; d > bound && i < latencyBuckets-1; bound *= 2 {
+		i++
+	}
+	s.buckets[i].Add(1)
+}
+
+// percentile returns the upper bound of the bucket containing the p-th percentile.
+func (s *latencyStats) percentile(p float64) time.Duration {
+	var total int64
+	for i := range s.buckets {
+		total += s.buckets[i].Load()
+	}
+	rank := int64(math.Ceil(p * float64(total)))
+	var seen int64
+	for i := range s.buckets {
+		if seen += s.buckets[i].Load(); seen >= rank && seen > 0 {
+			return time.Millisecond << i
+		}
+	}
+	return 0
+}
+
+// writeHistogram writes s as Prometheus histogram name in seconds.
+func (s *latencyStats) writeHistogram(w io.Writer, name, help string) {
+	_, _ = fmt.Fprintf(w, "# HELP %v %v\n", name, help)
+	_, _ = fmt.Fprintf(w, "# TYPE %v histogram\n", name)
+	var cumulative int64
+	for i := range latencyBuckets - 1 {
+		cumulative += s.buckets[i].Load()
+		_, _ = fmt.Fprintf(w, "%v_bucket{le=\"%g\"} %d\n", name, (time.Millisecond << i).Seconds(), cumulative)
+	}
+	count := s.count.Load()
+	_, _ = fmt.Fprintf(w, "%v_bucket{le=\"+Inf\"} %d\n", name, count)
+	_, _ = fmt.Fprintf(w, "%v_sum %g\n", name, time.Duration(s.sum.Load()).Seconds())
+	_, _ = fmt.Fprintf(w, "%v_count %d\n", name, count)
+}
+
+// latencySummary is the JSON representation of latencyStats.
+type latencySummary struct {
+	Count  int64  `json:"count"`
+	Errors int64  `json:"errors"`
+	Min    string `json:"min"`
+	Max    string `json:"max"`
+	P50    string `json:"p50"`
+	P90    string `json:"p90"`
+	P99    string `json:"p99"`
+}
+
+func (s *latencyStats) summary() latencySummary {
+	minD := time.Duration(0)
+	if s.count.Load() > 0 {
+		minD = time.Duration(s.min.Load())
+	}
+	return latencySummary{
+		Count:  s.count.Load(),
+		Errors: s.errors.Load(),
+		Min:    minD.String(),
+		Max:    time.Duration(s.max.Load()).String(),
+		P50:    s.percentile(0.5).String(),
+		P90:    s.percentile(0.9).String(),
+		P99:    s.percentile(0.99).String(),
+	}
+}
+
+func proxyStatsReport(w http.ResponseWriter) {
+	report := make(map[string]latencySummary, len(proxyStats))
+	for service, s := range proxyStats {
+		report[service] = s.summary()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(report)
+}
+
+// acceptStatsReport reports how long connections took from being accepted to
+// their first request, which grows when the accept queue is saturated.
+func acceptStatsReport(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(acceptStats.summary())
+}
+
+func poolStatsReport(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]latencySummary{
+		"idleBeforeReuse": idleReuseStats.summary(),
+		"idleBeforeClose": idleCloseStats.summary(),
+	})
+}
+
+// throttledReader slows down reading from r to simulate a slow upstream. It
+// pauses before every read and limits the throughput to rate bytes per second
+// if those are positive, and gives up once ctx is done.
+type throttledReader struct {
+	ctx   context.Context
+	r     io.Reader
+	rate  int64
+	pause time.Duration
+}
+
+func (t *throttledReader) wait(d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	select {
+	case <-time.After(d):
+		return nil
+	case <-t.ctx.Done():
+		return t.ctx.Err()
+	}
+}
+
+func (t *throttledReader) Read(b []byte) (int, error) {
+	if err := t.wait(t.pause); err != nil {
+		return 0, err
+	}
+	if t.rate > 0 {
+		// read in slices of 100ms worth of data for a smooth rate
+		b = b[:min(int64(len(b)), max(t.rate/10, 1))]
+	}
+	n, err := t.r.Read(b)
+	if t.rate > 0 && n > 0 {
+		if werr := t.wait(time.Duration(n) * time.Second / time.Duration(t.rate)); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
+
+// timeoutBudget returns the time budget for r from its timeoutBudgetHeader, or
+// else PROXY_TIMEOUT_BUDGET. It reports false if there is no budget at all.
+func timeoutBudget(r *http.Request) (time.Duration, bool, error) {
+	v := r.Header.Get(timeoutBudgetHeader)
+	if v == "" {
+		return proxyTimeoutBudget, proxyTimeoutBudget > 0, nil
+	}
+	budget, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, false, fmt.Errorf("invalid %v header %q", timeoutBudgetHeader, v)
+	}
+	return budget, true, nil
+}
+
+// parseThrottle returns a throttledReader configured by the throttle (bytes
+// per second) and stall (pause before every read) query parameters of r, or
+// nil if neither is set. Its reader still needs to be set.
+func parseThrottle(r *http.Request) (*throttledReader, error) {
+	q := r.URL.Query()
+	t := &throttledReader{ctx: r.Context()}
+	if rateStr := q.Get("throttle"); rateStr != "" {
+		rate, err := strconv.ParseInt(rateStr, 10, 64)
+		if err != nil || rate <= 0 {
+			return nil, errors.New("invalid throttle parameter")
+		}
+		t.rate = rate
+	}
+	if stallStr := q.Get("stall"); stallStr != "" {
+		stall, err := time.ParseDuration(stallStr)
+		if err != nil || stall < 0 {
+			return nil, errors.New("invalid stall parameter")
+		}
+		t.pause = stall
+	}
+	if t.rate == 0 && t.pause == 0 {
+		return nil, nil
+	}
+	return t, nil
+}
+
+// proxy forwards the request to the backend service. With flush set, every
+// chunk of the upstream body is flushed to the client as soon as it arrives
+// instead of leaving it to the buffering of the ResponseWriter.
+func proxy(service string, w http.ResponseWriter, r *http.Request, client *http.Client, flush bool) {
+	// Tie the upstream request to the client request, so that a client
+	// disconnect promptly cancels the upstream request instead of letting it
+	// stream into a dead writer. The upstream Host is always the service
+	// name, whatever Host the client sent, if any.
+	ctx := r.Context()
+	budget, hasBudget, err := timeoutBudget(r)
+	if err != nil {
+		http.Error(w, "Invalid "+timeoutBudgetHeader+" header\n", http.StatusBadRequest)
+		return
+	}
+	if hasBudget {
+		// all hops share one deadline, derived from the budget left
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, budget)
+		defer cancel()
+	}
+	var body io.Reader = http.NoBody
+	if r.ContentLength != 0 {
+		body = r.Body
+	}
+	req, err := http.NewRequestWithContext(ctx, r.Method, "http://"+service+"/", body)
+	if err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "%v: NewRequest err: %v\n", time.Now().Format(time.RFC3339), err)
+		http.Error(w, "Failed to create request\n", http.StatusInternalServerError)
+		return
+	}
+	// -1 streams a body of unknown length chunked
+	req.ContentLength = r.ContentLength
+	copyEndToEndHeaders(r.Header, req.Header)
+	setForwardedHeaders(r, req.Header)
+	hops, err := proxyHops(r)
+	if err != nil {
+		http.Error(w, "Invalid "+proxyHopsHeader+" header\n", http.StatusBadRequest)
+		return
+	}
+	throttle, err := parseThrottle(r)
+	if err != nil {
+		http.Error(w, "Invalid throttle or stall parameter\n", http.StatusBadRequest)
+		return
+	}
+	req.Header.Set(proxyHopsHeader, strconv.FormatInt(hops+1, 10))
+	if !proxyCompressionPassthrough {
+		// let the transport negotiate and transparently decompress gzip
+		req.Header.Del("Accept-Encoding")
+	}
+	req.URL.Path = r.URL.Path[1+len(service):]
+	req.URL.RawQuery = r.URL.RawQuery
+	stats := proxyStats[service]
+	if deadline, ok := ctx.Deadline(); ok && hasBudget {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			http.Error(w, "Timeout budget exhausted\n", http.StatusGatewayTimeout)
+			return
+		}
+		req.Header.Set(timeoutBudgetHeader, remaining.String())
+	}
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil && r.Context().Err() == nil && ctx.Err() != nil {
+		stats.errors.Add(1)
+		_, _ = fmt.Fprintf(os.Stderr, "%v: timeout budget of %v exhausted waiting for %v\n", time.Now().Format(time.RFC3339), budget, service)
+		http.Error(w, "Timeout budget exhausted\n", http.StatusGatewayTimeout)
+		return
+	}
+	if err != nil && r.Context().Err() != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "%v: client disconnected, canceled request to %v\n", time.Now().Format(time.RFC3339), service)
+		return
+	}
+	if err != nil {
+		stats.errors.Add(1)
+		_, _ = fmt.Fprintf(os.Stderr, "%v: request to envoy failed: %v\n", time.Now().Format(time.RFC3339), err)
+		http.Error(w, "Request to envoy failed\n", http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	copyEndToEndHeaders(resp.Header, w.Header())
+	if resp.Uncompressed {
+		// the transport decoded the body, so neither applies anymore
+		w.Header().Del("Content-Encoding")
+		w.Header().Del("Content-Length")
+	} else if resp.Header.Get("Content-Encoding") != "" {
+		// the body is still encoded, so caches need to know it depends on
+		// the client's Accept-Encoding
+		w.Header().Add("Vary", "Accept-Encoding")
+	}
+	w.WriteHeader(resp.StatusCode)
+	body = resp.Body
+	if throttle != nil {
+		throttle.r = resp.Body
+		body = throttle
+	}
+	if flush {
+		f := startPeriodicFlusher(r.Context(), w, 0)
+		_, err = io.Copy(f, body)
+		f.Stop()
+	} else {
+		_, err = io.Copy(w, body)
+	}
+	stats.record(time.Since(start))
+	if err != nil && r.Context().Err() != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "%v: client disconnected, canceled response from %v\n", time.Now().Format(time.RFC3339), service)
+		return
+	}
+	if err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "%v: failed to copy response body: %v\n", time.Now().Format(time.RFC3339), err)
+		return
+	}
+}
+
+type fanOutResult struct {
+	Service string `json:"service"`
+	Status  int    `json:"status,omitempty"`
+	Latency string `json:"latency"`
+	Reused  bool   `json:"reused"`
+	Bytes   int64  `json:"bytes"`
+	Error   string `json:"error,omitempty"`
+}
+
+// fanOut sends a request for path (default /) to each of the comma-separated
+// services (default all backends) concurrently, at most FAN_OUT_CONCURRENCY
+// at a time, and reports the status and latency of each and whether it
+// reused a pooled connection. All requests share one deadline of
+// FAN_OUT_TIMEOUT, or the timeout parameter.
+func fanOut(w http.ResponseWriter, r *http.Request, client *http.Client) {
+	q := r.URL.Query()
+	services := backends
+	if servicesStr := q.Get("services"); servicesStr != "" {
+		services = strings.Split(servicesStr, ",")
+		for _, service := range services {
+			if !slices.Contains(backends, service) {
+				http.Error(w, "Unknown service "+service+"\n", http.StatusBadRequest)
+				return
+			}
+		}
+	}
+	path := cmp.Or(q.Get("path"), "/")
+	timeout := fanOutTimeout
+	if timeoutStr := q.Get("timeout"); timeoutStr != "" {
+		var err error
+		if timeout, err = time.ParseDuration(timeoutStr); err != nil || timeout <= 0 {
+			http.Error(w, "Invalid timeout parameter\n", http.StatusBadRequest)
+			return
+		}
+	}
+	hops, err := proxyHops(r)
+	if err != nil {
+		http.Error(w, "Invalid "+proxyHopsHeader+" header\n", http.StatusBadRequest)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+	results := make([]fanOutResult, len(services))
+	sem := make(chan struct{}, max(fanOutConcurrency, 1))
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i, service := range services {
+		wg.Go(func() {
+			result := &results[i]
+			result.Service = service
+			select {
+			case sem <- struct{}{}:
+				defer func() { <-sem }()
+			case <-ctx.Done():
+				result.Error = ctx.Err().Error()
+				return
+			}
+			trace := &httptrace.ClientTrace{
+				GotConn: func(info httptrace.GotConnInfo) {
+					result.Reused = info.Reused
+				},
+			}
+			req, err := http.NewRequestWithContext(httptrace.WithClientTrace(ctx, trace), http.MethodGet, "http://"+service+path, http.NoBody)
+			if err != nil {
+				result.Error = err.Error()
+				return
+			}
+			forwardTraceHeaders(r.Header, req.Header)
+			req.Header.Set(proxyHopsHeader, strconv.FormatInt(hops+1, 10))
+			reqStart := time.Now()
+			resp, err := client.Do(req)
+			if err == nil {
+				result.Status = resp.StatusCode
+				result.Bytes, err = io.Copy(io.Discard, resp.Body)
+				_ = resp.Body.Close()
+			}
+			latency := time.Since(reqStart)
+			result.Latency = latency.String()
+			if stats, ok := proxyStats[service]; ok {
+				if err != nil {
+					stats.errors.Add(1)
+				} else {
+					stats.record(latency)
+				}
+			}
+			if err != nil {
+				result.Error = err.Error()
+			}
+		})
+	}
+	wg.Wait()
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"path":     path,
+		"duration": time.Since(start).String(),
+		"results":  results,
+	})
+}
+
+func ready(w http.ResponseWriter) {
+	if notReady.Load() {
+		if shutdownInitiated.Load() {
+			w.Header().Set("Connection", "close")
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+	} else {
+		_, _ = w.Write([]byte("OK"))
+	}
+}
+
+// startup reports 503 until the server completed its startup, i.e. listens,
+// passed the optional self-test and warmed up the optional connection pool.
+// Unlike readiness, it never goes back to 503 after that.
+func startup(w http.ResponseWriter) {
+	if !initialized.Load() {
+		http.Error(w, "Starting\n", http.StatusServiceUnavailable)
+		return
+	}
+	_, _ = w.Write([]byte("OK"))
+}
+
+type drainStatus struct {
+	Ready         bool       `json:"ready"`
+	Draining      bool       `json:"draining"`
+	Connections   int32      `json:"connections"`
+	DrainDeadline *time.Time `json:"drainDeadline,omitempty"`
+}
+
+func drainReady(w http.ResponseWriter) {
+	ds := drainStatus{
+		Ready:         !notReady.Load(),
+		Connections:   numConnections.Load(),
+		DrainDeadline: drainDeadline.Load(),
+	}
+	ds.Draining = ds.DrainDeadline != nil
+	w.Header().Set("Content-Type", "application/json")
+	if !ds.Ready {
+		if shutdownInitiated.Load() {
+			w.Header().Set("Connection", "close")
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	_ = json.NewEncoder(w).Encode(ds)
+}
+
+func status(w http.ResponseWriter, r *http.Request) {
+	codeStr := r.URL.Query().Get("code")
+	if codeStr == "" {
+		http.Error(w, "Missing code parameter\n", http.StatusBadRequest)
+		return
+	}
+	var code int
+	_, err := fmt.Sscanf(codeStr, "%d", &code)
+	if err != nil || code < 100 || code > 599 {
+		http.Error(w, "Invalid code parameter\n", http.StatusBadRequest)
+		return
+	}
+	body := fmt.Sprintf("Returned status code %d\n", code)
+	sizeStr := r.URL.Query().Get("size")
+	if sizeStr == "" {
+		writeNegotiated(w, r, code, body, map[string]any{"code": code})
+		return
+	}
+	// pad (or truncate) the plain text body to exactly size bytes
+	size, err := strconv.Atoi(sizeStr)
+	if err != nil || size < 0 || size > maxBytes {
+		http.Error(w, "Invalid size parameter\n", http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(size))
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(code)
+	if r.Method == http.MethodHead {
+		return
+	}
+	body = body[:min(size, len(body))]
+	if _, err = io.WriteString(w, body); err != nil {
+		return
+	}
+	size -= len(body)
+	buf := bytes.Repeat([]byte{'.'}, 32<<10)
+	for size > 0 && r.Context().Err() == nil {
+		chunk := buf[:min(size, len(buf))]
+		if _, err = w.Write(chunk); err != nil {
+			return
+		}
+		size -= len(chunk)
+	}
+}
+
+// errorReuse responds with the error status code given by the code parameter
+// (default 500), but with a fully delimited body and without Connection:
+// close, so that the client could reuse the connection. The request count of
+// the connection is always returned in X-Conn-Requests, so that a count
+// starting over at 1 on the next request reveals a client that closed the
+// connection after the error.
+func errorReuse(w http.ResponseWriter, r *http.Request) {
+	code := http.StatusInternalServerError
+	if codeStr := r.URL.Query().Get("code"); codeStr != "" {
+		var err error
+		code, err = strconv.Atoi(codeStr)
+		if err != nil || code < 400 || code > 599 {
+			http.Error(w, "Invalid code parameter\n", http.StatusBadRequest)
+			return
+		}
+	}
+	n := connInfoFrom(r.Context()).requests.Load()
+	body := fmt.Sprintf("Returned status code %d for request #%d on this connection, which stays open\n", code, n)
+	w.Header().Set("X-Conn-Requests", strconv.FormatInt(n, 10))
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(code)
+	if r.Method == http.MethodHead {
+		return
+	}
+	_, _ = io.WriteString(w, body)
+}
+
+// expectContinue tests how clients sending "Expect: 100-continue" handle the
+// possible answers and whether their connection stays reusable:
+//   - mode=continue (default) reads the body, for which net/http sends
+//     100 Continue, and responds with 200.
+//   - mode=reject responds with the final status given by code (default 417)
+//     without 100 Continue and without reading the body.
+//   - mode=continue-error sends 100 Continue but then responds with code
+//     (default 500) without reading the body.
+//
+// net/http closes the connection after the latter two if the body was not
+// read, since the client may or may not still send it.
+// The request count of the connection is returned in X-Conn-Requests.
+func expectContinue(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	mode := cmp.Or(q.Get("mode"), "continue")
+	code := 0
+	if codeStr := q.Get("code"); codeStr != "" {
+		var err error
+		if code, err = strconv.Atoi(codeStr); err != nil || code < 200 || code > 599 {
+			http.Error(w, "Invalid code parameter\n", http.StatusBadRequest)
+			return
+		}
+	}
+	expected := strings.EqualFold(r.Header.Get("Expect"), "100-continue")
+	var n int64
+	switch mode {
+	case "continue":
+		var err error
+		if n, err = io.Copy(io.Discard, r.Body); err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "%v: failed to read request body: %v\n", time.Now().Format(time.RFC3339), err)
+			http.Error(w, "Failed to read request body\n", http.StatusBadRequest)
+			return
+		}
+		code = cmp.Or(code, http.StatusOK)
+	case "reject":
+		code = cmp.Or(code, http.StatusExpectationFailed)
+	case "continue-error":
+		if expected {
+			w.WriteHeader(http.StatusContinue)
+		}
+		code = cmp.Or(code, http.StatusInternalServerError)
+	default:
+		http.Error(w, "Invalid mode parameter\n", http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("X-Conn-Requests", strconv.FormatInt(connInfoFrom(r.Context()).requests.Load(), 10))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"mode":           mode,
+		"expectContinue": expected,
+		"bytesRead":      n,
+	})
+}
+
+// rawBodyDumpLimit caps how much of the request body /raw echoes back.
+const rawBodyDumpLimit = 64 << 10
+
+func raw(w http.ResponseWriter, r *http.Request) {
+	// Read at most one byte more than the limit to detect truncation. Any
+	// remaining body is left to net/http, which drains it before reusing the
+	// connection (or closes the connection if too much is left).
+	body, err := io.ReadAll(io.LimitReader(r.Body, rawBodyDumpLimit+1))
+	if err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "%v: failed to read request body: %v\n", time.Now().Format(time.RFC3339), err)
+		http.Error(w, "Failed to read request body\n", http.StatusBadRequest)
+		return
+	}
+	truncated := len(body) > rawBodyDumpLimit
+	if truncated {
+		body = body[:rawBodyDumpLimit]
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	dump, err := httputil.DumpRequest(r, true)
+	if err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "%v: failed to dump request: %v\n", time.Now().Format(time.RFC3339), err)
+		http.Error(w, "Failed to dump request\n", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	_, _ = w.Write(dump)
+	if truncated {
+		_, _ = fmt.Fprintf(w, "\n[body truncated after %d bytes]\n", rawBodyDumpLimit)
+	}
+}
+
+// provenance reports how many proxy hops the request traversed and which
+// trace headers arrived with it.
+func provenance(w http.ResponseWriter, r *http.Request) {
+	hops, err := proxyHops(r)
+	if err != nil {
+		http.Error(w, "Invalid "+proxyHopsHeader+" header\n", http.StatusBadRequest)
+		return
+	}
+	trace := make(http.Header)
+	forwardTraceHeaders(r.Header, trace)
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"hops":         hops,
+		"maxHops":      maxProxyHops,
+		"proxied":      hops > 0,
+		"via":          r.Header.Values("Via"),
+		"traceHeaders": trace,
+	})
+}
+
+// multiStatus responds to each successive request on the same connection with
+// the next status code of the comma-separated codes parameter, starting over
+// after the last one.
+func multiStatus(w http.ResponseWriter, r *http.Request) {
+	var codes []int
+	for codeStr := range strings.SplitSeq(r.URL.Query().Get("codes"), ",") {
+		code, err := strconv.Atoi(strings.TrimSpace(codeStr))
+		if err != nil || code < 200 || code > 599 {
+			http.Error(w, "Invalid codes parameter\n", http.StatusBadRequest)
+			return
+		}
+		codes = append(codes, code)
+	}
+	n := connInfoFrom(r.Context()).multiStatus.Add(1)
+	code := codes[(n-1)%int64(len(codes))]
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(code)
+	_, _ = fmt.Fprintf(w, "Returned status code %d for request #%d on this connection\n", code, n)
+}
+
+// connAge reports the age of the connection the request was served on. Once
+// the connection is older than CONN_STALE_AGE, it hints the client to
+// reconnect and closes the connection, like servers that rotate aging
+// connections.
+func connAge(w http.ResponseWriter, r *http.Request) {
+	age := time.Since(connInfoFrom(r.Context()).accepted)
+	w.Header().Set("X-Conn-Age", age.Round(time.Millisecond).String())
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if connStaleAge > 0 && age > connStaleAge {
+		cw := &connectionCloseWriter{ResponseWriter: w, forceClose: true}
+		_, _ = fmt.Fprintf(cw, "Connection getting stale after %v, consider reconnecting\n", age.Round(time.Millisecond))
+		return
+	}
+	_, _ = fmt.Fprintf(w, "Connection is %v old\n", age.Round(time.Millisecond))
+}
+
+// host reports the Host the request arrived with. HTTP/1.1 requests without a
+// Host header never get here, but HTTP/1.0 requests do unless HOST_REQUIRED is
+// set. Requested via proxy, it shows the Host that proxy forwarded.
+func host(w http.ResponseWriter, r *http.Request) {
+	hops, _ := proxyHops(r)
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"present": r.Host != "",
+		"host":    r.Host,
+		"proto":   r.Proto,
+		// requests in absolute-form take the Host from the request target
+		"absoluteForm": r.URL.IsAbs(),
+		"proxyHops":    hops,
+	})
+}
+
+// tlsInfo reports the TLS parameters of the connection, in particular whether
+// it resumed an earlier TLS session, which saves a full handshake just like
+// a keep-alive connection saves the TCP and TLS handshakes altogether.
+func tlsInfo(w http.ResponseWriter, r *http.Request) {
+	if r.TLS == nil {
+		http.Error(w, "Not a TLS connection\n", http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"version":            tls.VersionName(r.TLS.Version),
+		"cipherSuite":        tls.CipherSuiteName(r.TLS.CipherSuite),
+		"serverName":         r.TLS.ServerName,
+		"negotiatedProtocol": r.TLS.NegotiatedProtocol,
+		"didResume":          r.TLS.DidResume,
+		"sessionTickets":     tlsSessionTickets,
+		"connRequests":       connInfoFrom(r.Context()).requests.Load(),
+	})
+}
+
+// hold keeps the request, and thereby its connection, busy for the duration
+// given by the for parameter (default 1s) and reports which connection served
+// it. Concurrent requests make a client open that many connections, of which
+// it keeps at most its maximum number of idle connections per host afterward,
+// as /pool-stats shows from the server's point of view.
+func hold(w http.ResponseWriter, r *http.Request) {
+	d := time.Second
+	if forStr := r.URL.Query().Get("for"); forStr != "" {
+		var err error
+		if d, err = time.ParseDuration(forStr); err != nil || d < 0 {
+			http.Error(w, "Invalid for parameter\n", http.StatusBadRequest)
+			return
+		}
+	}
+	select {
+	case <-time.After(d):
+	case <-r.Context().Done():
+		return
+	}
+	ci := connInfoFrom(r.Context())
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"conn":         ci.id,
+		"connRequests": ci.requests.Load(),
+		"held":         d.String(),
+	})
+}
+
+// events streams server-sent events, a tick every interval (default 1s),
+// until the client goes away. Once shutdown begins, clients receive a final
+// shutdown event, giving them the chance to reconnect elsewhere before the
+// connection is closed, unless SSE_SHUTDOWN_NOTIFY is false.
+func events(w http.ResponseWriter, r *http.Request) {
+	interval := time.Second
+	if intervalStr := r.URL.Query().Get("interval"); intervalStr != "" {
+		var err error
+		if interval, err = time.ParseDuration(intervalStr); err != nil || interval <= 0 {
+			http.Error(w, "Invalid interval parameter\n", http.StatusBadRequest)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	f := startPeriodicFlusher(r.Context(), w, 0)
+	defer f.Stop()
+	_, _ = fmt.Fprintf(f, ": connected\n\n")
+	shutdown := shutdownStarted
+	if !sseShutdownNotify {
+		shutdown = nil
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for i := 1; ; i++ {
+		select {
+		case <-ticker.C:
+			if _, err := fmt.Fprintf(f, "event: tick\nid: %d\ndata: %v\n\n", i, time.Now().Format(time.RFC3339)); err != nil {
+				return
+			}
+		case <-shutdown:
+			_, _ = fmt.Fprintf(f, "event: shutdown\ndata: %v\n\n", time.Now().Format(time.RFC3339))
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// checksumHashes are the hash algorithms /checksum supports.
+var checksumHashes = map[string]func() hash.Hash{
+	"sha256": sha256.New,
+	"crc32": func() hash.Hash {
+		return crc32.NewIEEE()
+	},
+}
+
+// checksum streams the request body through the hash given by the alg
+// parameter (sha256 by default, or crc32) and reports its hex digest. If the
+// client sent an X-Body-Checksum header, a differing digest is rejected with
+// 400 Bad Request.
+func checksum(w http.ResponseWriter, r *http.Request) {
+	alg := cmp.Or(r.URL.Query().Get("alg"), "sha256")
+	newHash, ok := checksumHashes[alg]
+	if !ok {
+		http.Error(w, "Invalid alg parameter\n", http.StatusBadRequest)
+		return
+	}
+	h := newHash()
+	n, err := io.Copy(h, r.Body)
+	if err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "%v: failed to read request body: %v\n", time.Now().Format(time.RFC3339), err)
+		http.Error(w, "Failed to read request body\n", http.StatusBadRequest)
+		return
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+	expected := r.Header.Get("X-Body-Checksum")
+	w.Header().Set("X-Body-Checksum", sum)
+	if expected != "" && !strings.EqualFold(expected, sum) {
+		http.Error(w, fmt.Sprintf("Checksum mismatch: expected %v, got %v\n", expected, sum), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"algorithm": alg,
+		"checksum":  sum,
+		"bytes":     n,
+		"verified":  expected != "",
+	})
+}
+
+// slowBodyRead reads the first after bytes (default 64KiB) of the request
+// body, then stops reading for pause (default 10s), so that TCP flow control
+// back-pressures the client's writes. Afterwards it reads the rest at rate
+// bytes per second (if positive), or with stop=true not at all, leaving it to
+// net/http to discard the rest or close the connection.
+func slowBodyRead(w http.ResponseWriter, r *http.Request) {
+	if !slowBodyReads {
+		http.Error(w, "Slow body reads require SLOW_BODY_READS=true\n", http.StatusForbidden)
+		return
+	}
+	q := r.URL.Query()
+	after := int64(64 << 10)
+	if afterStr := q.Get("after"); afterStr != "" {
+		var err error
+		after, err = strconv.ParseInt(afterStr, 10, 64)
+		if err != nil || after < 0 {
+			http.Error(w, "Invalid after parameter\n", http.StatusBadRequest)
+			return
+		}
+	}
+	pause := 10 * time.Second
+	if pauseStr := q.Get("pause"); pauseStr != "" {
+		var err error
+		pause, err = time.ParseDuration(pauseStr)
+		if err != nil || pause < 0 {
+			http.Error(w, "Invalid pause parameter\n", http.StatusBadRequest)
+			return
+		}
+	}
+	var rate int64
+	if rateStr := q.Get("rate"); rateStr != "" {
+		var err error
+		rate, err = strconv.ParseInt(rateStr, 10, 64)
+		if err != nil || rate < 0 {
+			http.Error(w, "Invalid rate parameter\n", http.StatusBadRequest)
+			return
+		}
+	}
+	start := time.Now()
+	stopped := false
+	n, err := io.CopyN(io.Discard, r.Body, after)
+	if err != nil && !errors.Is(err, io.EOF) {
+		_, _ = fmt.Fprintf(os.Stderr, "%v: failed to read request body: %v\n", time.Now().Format(time.RFC3339), err)
+		http.Error(w, "Failed to read request body\n", http.StatusBadRequest)
+		return
+	}
+	if err == nil {
+		select {
+		case <-time.After(pause):
+		case <-r.Context().Done():
+			return
+		}
+		stopped = q.Get("stop") == "true"
+		if !stopped {
+			var rest int64
+			rest, err = io.Copy(io.Discard, &throttledReader{ctx: r.Context(), r: r.Body, rate: rate})
+			n += rest
+			if err != nil {
+				_, _ = fmt.Fprintf(os.Stderr, "%v: failed to read request body: %v\n", time.Now().Format(time.RFC3339), err)
+				http.Error(w, "Failed to read request body\n", http.StatusBadRequest)
+				return
+			}
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"bytesRead": n,
+		"stopped":   stopped,
+		"duration":  time.Since(start).Round(time.Millisecond).String(),
+	})
+}
+
+func uptime(w http.ResponseWriter) {
+	up := time.Since(startTime)
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"start":         startTime.Format(time.RFC3339),
+		"uptime":        up.String(),
+		"uptimeSeconds": up.Seconds(),
+	})
+}
+
+// framing reports how net/http interpreted the message framing headers of the
+// request, which is where request smuggling attacks exploit discrepancies
+// between servers. Requests with ambiguous framing that net/http rejects (e.g.
+// duplicate differing Content-Length headers or unsupported Transfer-Encoding
+// values) never reach this handler, they are answered with 400 Bad Request.
+func framing(w http.ResponseWriter, r *http.Request) {
+	n, err := io.Copy(io.Discard, io.LimitReader(r.Body, rawBodyDumpLimit))
+	report := map[string]any{
+		"contentLength":          r.ContentLength,
+		"transferEncoding":       r.TransferEncoding,
+		"contentLengthHeader":    r.Header.Values("Content-Length"),
+		"transferEncodingHeader": r.Header.Values("Transfer-Encoding"),
+		"bodyBytesRead":          n,
+	}
+	if slices.Contains(r.TransferEncoding, "chunked") {
+		// net/http drops any Content-Length header of chunked requests
+		report["note"] = "chunked encoding takes precedence, any Content-Length was ignored"
+	}
+	if err != nil {
+		report["bodyError"] = err.Error()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(report)
+}
+
+// informational sends count 1xx responses (103 Early Hints by default) with
+// the Link headers given as link parameters before the final response.
+func informational(w http.ResponseWriter, r *http.Request) {
+	code, count := http.StatusEarlyHints, 1
+	var err error
+	if codeStr := r.URL.Query().Get("code"); codeStr != "" {
+		if code, err = strconv.Atoi(codeStr); err != nil || !isInformational(code) {
+			http.Error(w, "Invalid code parameter\n", http.StatusBadRequest)
+			return
+		}
+	}
+	if countStr := r.URL.Query().Get("count"); countStr != "" {
+		if count, err = strconv.Atoi(countStr); err != nil || count < 0 || count > 10 {
+			http.Error(w, "Invalid count parameter\n", http.StatusBadRequest)
+			return
+		}
+	}
+	for _, link := range r.URL.Query()["link"] {
+		w.Header().Add("Link", link)
+	}
+	for range count {
+		w.WriteHeader(code)
+	}
+	_, _ = fmt.Fprintf(w, "Sent %d informational %d responses\n", count, code)
+}
+
+// parseByteSize parses a number of bytes with an optional KB, MB or GB suffix,
+// which are taken as powers of 1024.
+func parseByteSize(s string) (int64, error) {
+	multiplier := int64(1)
+	for suffix, m := range map[string]int64{"KB": 1 << 10, "MB": 1 << 20, "GB": 1 << 30} {
+		if trimmed, ok := strings.CutSuffix(strings.ToUpper(s), suffix); ok {
+			s, multiplier = trimmed, m
+			break
+		}
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if n < 0 || n > math.MaxInt64/multiplier {
+		return 0, fmt.Errorf("size out of range: %v", s)
+	}
+	return n * multiplier, nil
+}
+
+// allocGarbage allocates as many bytes as given by the alloc parameter (e.g.
+// 10MB, at most MAX_ALLOC) and drops them again before responding, creating
+// short-lived garbage that puts pressure on the GC. If the heap exceeds the
+// gc_above parameter afterward, a GC is forced. It reports the heap before
+// and after and how many GC cycles ran meanwhile.
+func allocGarbage(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	size, err := parseByteSize(q.Get("alloc"))
+	if err != nil || size > maxAlloc {
+		http.Error(w, "Invalid alloc parameter\n", http.StatusBadRequest)
+		return
+	}
+	var gcAbove int64
+	if gcAboveStr := q.Get("gc_above"); gcAboveStr != "" {
+		if gcAbove, err = parseByteSize(gcAboveStr); err != nil {
+			http.Error(w, "Invalid gc_above parameter\n", http.StatusBadRequest)
+			return
+		}
+	}
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	start := time.Now()
+	// allocate in 1MiB chunks and touch every page, so that the memory is
+	// actually committed
+	chunks := make([][]byte, 0, size>>20+1)
+	for remaining := size; remaining > 0; remaining -= 1 << 20 {
+		chunk := make([]byte, min(remaining, 1<<20))
+		for i := 0; i < len(chunk); i += 4096 {
+			chunk[i] = 1
+		}
+		chunks = append(chunks, chunk)
+	}
+	elapsed := time.Since(start)
+	runtime.ReadMemStats(&after)
+	// the memory becomes garbage from here on, before responding
+	runtime.KeepAlive(chunks)
+	forcedGC := gcAbove > 0 && after.HeapAlloc > uint64(gcAbove)
+	if forcedGC {
+		runtime.GC()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"allocated":    size,
+		"duration":     elapsed.String(),
+		"heapBefore":   before.HeapAlloc,
+		"heapAfter":    after.HeapAlloc,
+		"gcCycles":     after.NumGC - before.NumGC,
+		"gcPauseTotal": time.Duration(after.PauseTotalNs - before.PauseTotalNs).String(),
+		"forcedGC":     forcedGC,
+	})
+}
+
+// maxBytes caps the size of /bytes responses.
+const maxBytes = 1 << 30
+
+// randomBytes streams n pseudo-random bytes. Given a seed, the same byte
+// sequence is returned for the same seed and size on every request.
+func randomBytes(w http.ResponseWriter, r *http.Request) {
+	n, err := strconv.ParseInt(r.URL.Query().Get("n"), 10, 64)
+	if err != nil || n < 0 || n > maxBytes {
+		http.Error(w, "Invalid n parameter\n", http.StatusBadRequest)
+		return
+	}
+	seed := rand.Int63()
+	if seedStr := r.URL.Query().Get("seed"); seedStr != "" {
+		if seed, err = strconv.ParseInt(seedStr, 10, 64); err != nil {
+			http.Error(w, "Invalid seed parameter\n", http.StatusBadRequest)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.FormatInt(n, 10))
+	if r.Method == http.MethodHead {
+		// let clients probe the size without generating the body
+		return
+	}
+	rnd := rand.New(rand.NewSource(seed))
+	buf := make([]byte, 32<<10)
+	for n > 0 && r.Context().Err() == nil {
+		chunk := buf[:min(n, int64(len(buf)))]
+		_, _ = rnd.Read(chunk)
+		if _, err = w.Write(chunk); err != nil {
+			return
+		}
+		n -= int64(len(chunk))
+	}
+}
+
+// sized responds with a body of a size drawn from the distribution given by
+// the pdf parameter (e.g. 1KB:0.8,1MB:0.2), which it reports in the
+// X-Response-Size header.
+func sized(w http.ResponseWriter, r *http.Request) {
+	inverseCDF, err := parseSizePDF(r.URL.Query().Get("pdf"))
+	if err != nil {
+		http.Error(w, "Invalid pdf parameter: "+err.Error()+"\n", http.StatusBadRequest)
+		return
+	}
+	size := inverseCDF()
+	w.Header().Set("X-Response-Size", strconv.FormatInt(size, 10))
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	if r.Method == http.MethodHead {
+		return
+	}
+	buf := bytes.Repeat([]byte{'x'}, 32<<10)
+	for size > 0 && r.Context().Err() == nil {
+		chunk := buf[:min(size, int64(len(buf)))]
+		if _, err = w.Write(chunk); err != nil {
+			return
+		}
+		size -= int64(len(chunk))
+	}
+}
+
+// boundary responds with exactly size bytes (e.g. 4096, 8192 or 16384) with a
+// matching Content-Length, to probe clients for off-by-one errors parsing the
+// next response on the same connection when a body ends at a buffer boundary.
+// The body repeats the hex digits and ends with a newline. The request count
+// of the connection is returned in X-Conn-Requests to verify its reuse.
+func boundary(w http.ResponseWriter, r *http.Request) {
+	size, err := strconv.ParseInt(r.URL.Query().Get("size"), 10, 64)
+	if err != nil || size < 0 || size > maxBytes {
+		http.Error(w, "Invalid size parameter\n", http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("X-Conn-Requests", strconv.FormatInt(connInfoFrom(r.Context()).requests.Load(), 10))
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	if r.Method == http.MethodHead {
+		return
+	}
+	// a multiple of 16, so that every chunk starts with the same digit
+	buf := []byte(strings.Repeat("0123456789abcdef", 2<<10))
+	for size > 0 && r.Context().Err() == nil {
+		chunk := buf[:min(size, int64(len(buf)))]
+		if size <= int64(len(buf)) {
+			chunk = slices.Clone(chunk)
+			chunk[len(chunk)-1] = '\n'
+		}
+		if _, err = w.Write(chunk); err != nil {
+			return
+		}
+		size -= int64(len(chunk))
+	}
+}
+
+// defaultRetryAfterPDF spreads retries evenly over one to five seconds.
+const defaultRetryAfterPDF = "1s:1,2s:1,3s:1,4s:1,5s:1"
+
+// backpressure rejects the request with 503 and a Retry-After drawn from the
+// distribution given by the pdf parameter, so that clients retrying as told
+// spread out instead of retrying in synchronized waves.
+func backpressure(w http.ResponseWriter, r *http.Request) {
+	pdf := r.URL.Query().Get("pdf")
+	if pdf == "" {
+		pdf = defaultRetryAfterPDF
+	}
+	inverseCDF, err := parsePDF(pdf)
+	if err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "%v: invalid pdf: %v\n", time.Now().Format(time.RFC3339), err)
+		http.Error(w, "Invalid pdf parameter: "+err.Error()+"\n", http.StatusBadRequest)
+		return
+	}
+	// Retry-After only supports whole seconds
+	retryAfter := int(math.Ceil(inverseCDF().Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	http.Error(w, fmt.Sprintf("Service unavailable, retry after %ds\n", retryAfter), http.StatusServiceUnavailable)
+}
+
+// setCookieFromQuery builds the cookie described by the query parameters
+// name, value, secure, httponly, samesite and maxage.
+func setCookieFromQuery(q url.Values) (*http.Cookie, error) {
+	c := &http.Cookie{
+		Name:  q.Get("name"),
+		Value: q.Get("value"),
+		Path:  "/",
+	}
+	var err error
+	if v := q.Get("secure"); v != "" {
+		if c.Secure, err = strconv.ParseBool(v); err != nil {
+			return nil, fmt.Errorf("invalid secure: %w", err)
+		}
+	}
+	if v := q.Get("httponly"); v != "" {
+		if c.HttpOnly, err = strconv.ParseBool(v); err != nil {
+			return nil, fmt.Errorf("invalid httponly: %w", err)
+		}
+	}
+	switch strings.ToLower(q.Get("samesite")) {
+	case "":
+	case "lax":
+		c.SameSite = http.SameSiteLaxMode
+	case "strict":
+		c.SameSite = http.SameSiteStrictMode
+	case "none":
+		c.SameSite = http.SameSiteNoneMode
+	default:
+		return nil, fmt.Errorf("invalid samesite: %v", q.Get("samesite"))
+	}
+	if v := q.Get("maxage"); v != "" {
+		if c.MaxAge, err = strconv.Atoi(v); err != nil {
+			return nil, fmt.Errorf("invalid maxage: %w", err)
+		}
+	}
+	if err = c.Valid(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func cookie(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Has("name") {
+		c, err := setCookieFromQuery(r.URL.Query())
+		if err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "%v: invalid cookie: %v\n", time.Now().Format(time.RFC3339), err)
+			http.Error(w, "Invalid cookie parameters\n", http.StatusBadRequest)
+			return
+		}
+		http.SetCookie(w, c)
+	}
+	cookies := make(map[string]string)
+	for _, c := range r.Cookies() {
+		cookies[c.Name] = c.Value
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(cookies)
+}
+
+// grpcPercentEncode encodes a grpc-message value as required by the gRPC
+// over HTTP/2 specification.
+func grpcPercentEncode(msg string) string {
+	var sb strings.Builder
+	for i := 0; i < len(msg); i++ {
+		if c := msg[i]; c < 0x20 || c > 0x7e || c == '%' {
+			_, _ = fmt.Fprintf(&sb, "%%%02X", c)
+		} else {
+			sb.WriteByte(c)
+		}
+	}
+	return sb.String()
+}
+
+// grpcStatus responds like a gRPC server with a trailers-only error: headers,
+// no body and the status transported via the grpc-status/grpc-message trailers.
+func grpcStatus(w http.ResponseWriter, r *http.Request) {
+	code := 2 // UNKNOWN
+	if codeStr := r.URL.Query().Get("code"); codeStr != "" {
+		var err error
+		if code, err = strconv.Atoi(codeStr); err != nil || code < 0 || code > 16 {
+			http.Error(w, "Invalid code parameter\n", http.StatusBadRequest)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+	w.WriteHeader(http.StatusOK)
+	w.Header().Set("Grpc-Status", strconv.Itoa(code))
+	w.Header().Set("Grpc-Message", grpcPercentEncode(r.URL.Query().Get("message")))
+}
+
+// violate breaks the keep-alive contract to test client resilience:
+//   - mode=close-on-keepalive announces "Connection: keep-alive" but closes the
+//     connection right after the response.
+//   - mode=keepalive-on-close announces "Connection: close" but keeps the
+//     connection open until the client closes it or clientSideIdleTimeout passes.
+func violate(w http.ResponseWriter, r *http.Request) {
+	mode := r.URL.Query().Get("mode")
+	var connHeader string
+	switch mode {
+	case "close-on-keepalive":
+		connHeader = "keep-alive"
+	case "keepalive-on-close":
+		connHeader = "close"
+	default:
+		http.Error(w, "Invalid mode parameter\n", http.StatusBadRequest)
+		return
+	}
+	conn, buf, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "%v: hijack failed: %v\n", time.Now().Format(time.RFC3339), err)
+		http.Error(w, "Hijacking not supported\n", http.StatusInternalServerError)
+		return
+	}
+	defer conn.Close()
+	body := fmt.Sprintf("Violating keep-alive contract: %v\n", mode)
+	_, _ = fmt.Fprintf(buf, "HTTP/1.1 200 OK\r\nConnection: %v\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Length: %d\r\n\r\n%v",
+		connHeader, len(body), body)
+	if err = buf.Flush(); err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "%v: failed to write response: %v\n", time.Now().Format(time.RFC3339), err)
+		return
+	}
+	if mode == "keepalive-on-close" {
+		// discard anything the client still sends until it gives up on the connection
+		_ = conn.SetReadDeadline(time.Now().Add(clientSideIdleTimeout))
+		_, _ = io.Copy(io.Discard, buf)
+	}
+}
+
+// slowHeaders writes the response headers one at a time with a delay in
+// between, which net/http would otherwise buffer and send at once, to test
+// client response header timeouts. The connection is closed afterward.
+func slowHeaders(w http.ResponseWriter, r *http.Request) {
+	if !rawResponses {
+		http.Error(w, "Slow headers require RAW_RESPONSES=true\n", http.StatusForbidden)
+		return
+	}
+	count := 5
+	if countStr := r.URL.Query().Get("count"); countStr != "" {
+		var err error
+		if count, err = strconv.Atoi(countStr); err != nil || count < 0 || count > 100 {
+			http.Error(w, "Invalid count parameter\n", http.StatusBadRequest)
+			return
+		}
+	}
+	delay := time.Second
+	if delayStr := r.URL.Query().Get("delay"); delayStr != "" {
+		var err error
+		if delay, err = time.ParseDuration(delayStr); err != nil || delay < 0 {
+			http.Error(w, "Invalid delay parameter\n", http.StatusBadRequest)
+			return
+		}
+	}
+	conn, buf, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "%v: hijack failed: %v\n", time.Now().Format(time.RFC3339), err)
+		http.Error(w, "Hijacking not supported\n", http.StatusInternalServerError)
+		return
+	}
+	defer conn.Close()
+	_, _ = buf.WriteString("HTTP/1.1 200 OK\r\n")
+	for i := 1; i <= count; i++ {
+		_, _ = fmt.Fprintf(buf, "X-Slow-Header-%d: %d/%d\r\n", i, i, count)
+		if err := buf.Flush(); err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "%v: failed to write header: %v\n", time.Now().Format(time.RFC3339), err)
+			return
+		}
+		time.Sleep(delay)
+	}
+	body := fmt.Sprintf("Sent %d headers %v apart\n", count, delay)
+	_, _ = fmt.Fprintf(buf, "Connection: close\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Length: %d\r\n\r\n%v", len(body), body)
+	_ = buf.Flush()
+}
+
+// headerCasing writes the response headers with the casing given by the case
+// parameter (canonical, lower, upper or random) and, with shuffle=true, in
+// random order, which net/http would otherwise canonicalize and sort. The
+// connection is closed afterward.
+func headerCasing(w http.ResponseWriter, r *http.Request) {
+	if !rawResponses {
+		http.Error(w, "Raw header casing requires RAW_RESPONSES=true\n", http.StatusForbidden)
+		return
+	}
+	mode := cmp.Or(r.URL.Query().Get("case"), "canonical")
+	var recase func(string) string
+	switch mode {
+	case "canonical":
+		recase = http.CanonicalHeaderKey
+	case "lower":
+		recase = strings.ToLower
+	case "upper":
+		recase = strings.ToUpper
+	case "random":
+		recase = func(name string) string {
+			b := []byte(name)
+			for i, c := range b {
+				if ('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z') && rand.Intn(2) == 0 {
+					// flip the case of the ASCII letter
+					b[i] = c ^ 0x20
+				}
+			}
+			return string(b)
+		}
+	default:
+		http.Error(w, "Invalid case parameter\n", http.StatusBadRequest)
+		return
+	}
+	body := fmt.Sprintf("Headers written in %v case\n", mode)
+	headers := [][2]string{
+		{"Content-Type", "text/plain; charset=utf-8"},
+		{"Content-Length", strconv.Itoa(len(body))},
+		{"Date", time.Now().UTC().Format(http.TimeFormat)},
+		{"Cache-Control", "no-cache"},
+		{"X-Header-Casing", mode},
+		{"Connection", "close"},
+	}
+	if r.URL.Query().Get("shuffle") == "true" {
+		rand.Shuffle(len(headers), func(i, j int) {
+			headers[i], headers[j] = headers[j], headers[i]
+		})
+	}
+	conn, buf, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "%v: hijack failed: %v\n", time.Now().Format(time.RFC3339), err)
+		http.Error(w, "Hijacking not supported\n", http.StatusInternalServerError)
+		return
+	}
+	defer conn.Close()
+	_, _ = buf.WriteString("HTTP/1.1 200 OK\r\n")
+	for _, h := range headers {
+		_, _ = fmt.Fprintf(buf, "%v: %v\r\n", recase(h[0]), h[1])
+	}
+	_, _ = fmt.Fprintf(buf, "\r\n%v", body)
+	if err = buf.Flush(); err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "%v: failed to write response: %v\n", time.Now().Format(time.RFC3339), err)
+	}
+}
+
+// closeDelimited responds with neither Content-Length nor chunked encoding,
+// so that only closing the connection delimits the body, which clients must
+// not try to reuse. The body consists of lines parameter lines, sent delay
+// apart. Without close_header=true, the response does not even announce the
+// close with Connection: close.
+func closeDelimited(w http.ResponseWriter, r *http.Request) {
+	if !rawResponses {
+		http.Error(w, "Close-delimited responses require RAW_RESPONSES=true\n", http.StatusForbidden)
+		return
+	}
+	q := r.URL.Query()
+	lines := 3
+	if linesStr := q.Get("lines"); linesStr != "" {
+		var err error
+		if lines, err = strconv.Atoi(linesStr); err != nil || lines < 0 || lines > 10000 {
+			http.Error(w, "Invalid lines parameter\n", http.StatusBadRequest)
+			return
+		}
+	}
+	var delay time.Duration
+	if delayStr := q.Get("delay"); delayStr != "" {
+		var err error
+		if delay, err = time.ParseDuration(delayStr); err != nil || delay < 0 {
+			http.Error(w, "Invalid delay parameter\n", http.StatusBadRequest)
+			return
+		}
+	}
+	conn, buf, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "%v: hijack failed: %v\n", time.Now().Format(time.RFC3339), err)
+		http.Error(w, "Hijacking not supported\n", http.StatusInternalServerError)
+		return
+	}
+	// closing the connection is what ends the body
+	defer conn.Close()
+	_, _ = buf.WriteString("HTTP/1.1 200 OK\r\nContent-Type: text/plain; charset=utf-8\r\n")
+	if q.Get("close_header") == "true" {
+		_, _ = buf.WriteString("Connection: close\r\n")
+	}
+	_, _ = buf.WriteString("\r\n")
+	for i := 1; i <= lines; i++ {
+		_, _ = fmt.Fprintf(buf, "line %d/%d, delimited by the connection close\n", i, lines)
+		if delay > 0 {
+			if err := buf.Flush(); err != nil {
+				return
+			}
+			time.Sleep(delay)
+		}
+	}
+	_ = buf.Flush()
+}
+
+// chunked produces chunked responses to test Transfer-Encoding handling:
+//   - mode=plain streams chunks without trailers.
+//   - mode=trailers streams chunks followed by an X-Chunk-Count trailer.
+//   - mode=bad-size, mode=short-chunk and mode=unterminated write deliberately
+//     malformed chunked encoding and require RAW_RESPONSES=true.
+func chunked(w http.ResponseWriter, r *http.Request) {
+	n := 3
+	if chunksStr := r.URL.Query().Get("chunks"); chunksStr != "" {
+		var err error
+		if n, err = strconv.Atoi(chunksStr); err != nil || n < 1 {
+			http.Error(w, "Invalid chunks parameter\n", http.StatusBadRequest)
+			return
+		}
+	}
+	mode := r.URL.Query().Get("mode")
+	switch mode {
+	case "", "plain", "trailers":
+		if mode == "trailers" {
+			w.Header().Set("Trailer", "X-Chunk-Count")
+		}
+		f := startPeriodicFlusher(r.Context(), w, 0)
+		for i := 1; i <= n; i++ {
+			if _, err := fmt.Fprintf(f, "chunk %d/%d\n", i, n); err != nil {
+				return
+			}
+		}
+		f.Stop()
+		if mode == "trailers" {
+			w.Header().Set("X-Chunk-Count", strconv.Itoa(n))
+		}
+	case "bad-size", "short-chunk", "unterminated":
+		if !rawResponses {
+			http.Error(w, "Malformed responses require RAW_RESPONSES=true\n", http.StatusForbidden)
+			return
+		}
+		conn, buf, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "%v: hijack failed: %v\n", time.Now().Format(time.RFC3339), err)
+			http.Error(w, "Hijacking not supported\n", http.StatusInternalServerError)
+			return
+		}
+		defer conn.Close()
+		_, _ = buf.WriteString("HTTP/1.1 200 OK\r\nContent-Type: text/plain; charset=utf-8\r\nTransfer-Encoding: chunked\r\n\r\n")
+		for i := 1; i <= n; i++ {
+			chunk := fmt.Sprintf("chunk %d/%d\n", i, n)
+			_, _ = fmt.Fprintf(buf, "%x\r\n%v\r\n", len(chunk), chunk)
+		}
+		switch mode {
+		case "bad-size":
+			_, _ = buf.WriteString("zz\r\ninvalid chunk size\r\n0\r\n\r\n")
+		case "short-chunk":
+			_, _ = buf.WriteString("100\r\nshorter than announced\r\n0\r\n\r\n")
+		case "unterminated":
+			// no last-chunk, the connection is closed instead
+		}
+		_ = buf.Flush()
+	default:
+		http.Error(w, "Invalid mode parameter\n", http.StatusBadRequest)
+	}
+}
+
+var pingBody = []byte("pong\n")
+var pingContentType = []string{"text/plain; charset=utf-8"}
+var pingConnectionClose = []string{"close"}
+
+// ping responds with a fixed tiny body and does as little as possible, so that
+// the time measured by clients is dominated by the network and the state of
+// the connection. It is registered without any middleware.
+func ping(w http.ResponseWriter) {
+	h := w.Header()
+	h["Content-Type"] = pingContentType
+	if shutdownInitiated.Load() && gracefulShutdown {
+		h["Connection"] = pingConnectionClose
+	}
+	_, _ = w.Write(pingBody)
+}
+
+// maxRTTSamples caps the number of round trips /rtt measures.
+const maxRTTSamples = 1000
+
+type rttSample struct {
+	Millis float64 `json:"ms"`
+	Reused bool    `json:"reused"`
+}
+
+// rtt measures round trips to the /ping endpoint (or path) of a backend or of
+// this server (service=self) through the proxy client, reporting for each
+// whether a warm keep-alive connection was reused. With cold=true every round
+// trip uses a new connection instead.
+func rtt(w http.ResponseWriter, r *http.Request, client *http.Client) {
+	q := r.URL.Query()
+	service := cmp.Or(q.Get("service"), "self")
+	path := cmp.Or(q.Get("path"), "/ping")
+	target := "http://" + service + path
+	if service == "self" {
+		target = selfURL + path
+	} else if !slices.Contains(backends, service) {
+		http.Error(w, "Unknown service\n", http.StatusBadRequest)
+		return
+	}
+	n := 10
+	if nStr := q.Get("n"); nStr != "" {
+		var err error
+		n, err = strconv.Atoi(nStr)
+		if err != nil || n < 1 || n > maxRTTSamples {
+			http.Error(w, "Invalid n parameter\n", http.StatusBadRequest)
+			return
+		}
+	}
+	if q.Get("cold") == "true" {
+		// measure on a separate transport to not close pooled connections
+		if transport, ok := client.Transport.(*http.Transport); ok {
+			transport = transport.Clone()
+			transport.DisableKeepAlives = true
+			defer transport.CloseIdleConnections()
+			client = &http.Client{Transport: transport, Timeout: client.Timeout}
+		}
+	}
+	samples := make([]rttSample, 0, n)
+	var warm, fresh []time.Duration
+	for range n {
+		var reused bool
+		trace := &httptrace.ClientTrace{
+			GotConn: func(info httptrace.GotConnInfo) {
+				reused = info.Reused
+			},
+		}
+		req, err := http.NewRequestWithContext(httptrace.WithClientTrace(r.Context(), trace), http.MethodGet, target, nil)
+		if err != nil {
+			http.Error(w, "Invalid path parameter\n", http.StatusBadRequest)
+			return
+		}
+		start := time.Now()
+		resp, err := client.Do(req)
+		if err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "%v: round trip to %v failed: %v\n", time.Now().Format(time.RFC3339), target, err)
+			http.Error(w, "Round trip failed\n", http.StatusBadGateway)
+			return
+		}
+		_, _ = io.Copy(io.Discard, resp.Body)
+		_ = resp.Body.Close()
+		d := time.Since(start)
+		samples = append(samples, rttSample{Millis: float64(d.Microseconds()) / 1000, Reused: reused})
+		if reused {
+			warm = append(warm, d)
+		} else {
+			fresh = append(fresh, d)
+		}
+	}
+	avg := func(ds []time.Duration) string {
+		if len(ds) == 0 {
+			return "n/a"
+		}
+		var sum time.Duration
+		for _, d := range ds {
+			sum += d
+		}
+		return (sum / time.Duration(len(ds))).String()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"target":     target,
+		"samples":    samples,
+		"avgReused":  avg(warm),
+		"avgNewConn": avg(fresh),
+	})
+}
+
+// tlsHandshakeCost compares n HTTPS round trips on new connections with n
+// round trips on one reused keep-alive connection to url (default /ping of
+// this server, which needs TLS_CERT_FILE), showing the TLS handshake cost that
+// keep-alive avoids. insecure=true skips certificate verification, e.g. for
+// self-signed demo certificates.
+func tlsHandshakeCost(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	target := q.Get("url")
+	if target == "" {
+		target = "https://" + strings.TrimPrefix(selfURL, "http://") + "/ping"
+	}
+	if !strings.HasPrefix(target, "https://") {
+		http.Error(w, "Invalid url parameter, must be https\n", http.StatusBadRequest)
+		return
+	}
+	n := 10
+	if nStr := q.Get("n"); nStr != "" {
+		var err error
+		n, err = strconv.Atoi(nStr)
+		if err != nil || n < 1 || n > maxRTTSamples {
+			http.Error(w, "Invalid n parameter\n", http.StatusBadRequest)
+			return
+		}
+	}
+	tlsConfig := &tls.Config{InsecureSkipVerify: q.Get("insecure") == "true"}
+	fresh := &http.Transport{TLSClientConfig: tlsConfig, DisableKeepAlives: true}
+	reused := &http.Transport{TLSClientConfig: tlsConfig, MaxIdleConnsPerHost: 1}
+	defer reused.CloseIdleConnections()
+	var handshakes []time.Duration
+	measure := func(transport *http.Transport) (time.Duration, error) {
+		var handshakeStart time.Time
+		trace := &httptrace.ClientTrace{
+			TLSHandshakeStart: func() {
+				handshakeStart = time.Now()
+			},
+			TLSHandshakeDone: func(tls.ConnectionState, error) {
+				handshakes = append(handshakes, time.Since(handshakeStart))
+			},
+		}
+		req, err := http.NewRequestWithContext(httptrace.WithClientTrace(r.Context(), trace), http.MethodGet, target, nil)
+		if err != nil {
+			return 0, err
+		}
+		start := time.Now()
+		resp, err := transport.RoundTrip(req)
+		if err != nil {
+			return 0, err
+		}
+		_, _ = io.Copy(io.Discard, resp.Body)
+		_ = resp.Body.Close()
+		return time.Since(start), nil
+	}
+	var freshTotal, reusedTotal time.Duration
+	// the first round trip on the reused transport opens its connection
+	for i := range 2*n + 1 {
+		transport := fresh
+		if i >= n {
+			transport = reused
+		}
+		d, err := measure(transport)
+		if err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "%v: round trip to %v failed: %v\n", time.Now().Format(time.RFC3339), target, err)
+			http.Error(w, "Round trip failed\n", http.StatusBadGateway)
+			return
+		}
+		switch {
+		case i < n:
+			freshTotal += d
+		case i > n:
+			reusedTotal += d
+		}
+	}
+	var handshakeTotal time.Duration
+	for _, d := range handshakes {
+		handshakeTotal += d
+	}
+	avgFresh := freshTotal / time.Duration(n)
+	avgReused := reusedTotal / time.Duration(n)
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"target":       target,
+		"n":            n,
+		"handshakes":   len(handshakes),
+		"avgHandshake": (handshakeTotal / time.Duration(max(len(handshakes), 1))).String(),
+		"avgNewConn":   avgFresh.String(),
+		"avgReused":    avgReused.String(),
+		"delta":        (avgFresh - avgReused).String(),
+	})
+}
+
+// servesHTTP2 reports whether server speaks HTTP/2, either negotiated via TLS
+// ALPN or with prior knowledge over cleartext (h2c).
+func servesHTTP2(server *http.Server) bool {
+	if server.Protocols == nil {
+		// net/http negotiates HTTP/2 over TLS by default
+		return server.TLSConfig != nil
+	}
+	return server.Protocols.UnencryptedHTTP2() || server.TLSConfig != nil && server.Protocols.HTTP2()
+}
+
+// keepAliveInfo reports all keep-alive related timeouts of the server and the
+// proxy client in one place.
+func keepAliveInfo(w http.ResponseWriter, client *http.Client, server *http.Server) {
+	timeout := func(d time.Duration) string {
+		if d <= 0 {
+			return "none"
+		}
+		return d.String()
+	}
+	// net/http falls back to ReadTimeout if IdleTimeout is not set
+	serverIdleTimeout := server.IdleTimeout
+	if serverIdleTimeout == 0 {
+		serverIdleTimeout = server.ReadTimeout
+	}
+	info := map[string]any{
+		"server": map[string]any{
+			"idleTimeout":       timeout(serverIdleTimeout),
+			"readTimeout":       timeout(server.ReadTimeout),
+			"readHeaderTimeout": timeout(server.ReadHeaderTimeout),
+			"writeTimeout":      timeout(server.WriteTimeout),
+			"keepAlivesEnabled": !keepAlivesDisabled.Load(),
+			// net.Listen enables TCP keep-alive probes with the default interval
+			"tcpKeepAlive":          "15s",
+			"shutdownSleepDuration": shutdownSleepDuration.String(),
+			"drainTimeout":          clientSideIdleTimeout.String(),
+			"http2Enabled":          servesHTTP2(server),
+		},
+	}
+	if transport, ok := client.Transport.(*http.Transport); ok {
+		info["client"] = map[string]any{
+			"idleConnTimeout":     timeout(transport.IdleConnTimeout),
+			"maxIdleConns":        transport.MaxIdleConns,
+			"maxIdleConnsPerHost": transport.MaxIdleConnsPerHost,
+			"disableKeepAlives":   transport.DisableKeepAlives,
+			// http.DefaultTransport's dialer sends TCP keep-alive probes every 30s
+			"tcpKeepAlive": "30s",
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(info)
+}
+
+func registerHandlers(mux *http.ServeMux, client *http.Client, server *http.Server) {
+	// handle registers h with the middlewares that apply to all routes.
+	handle := func(pattern string, h http.Handler) {
+		mux.Handle(pattern, withRequestMetrics(pattern, withLoadShedding(withConnTracking(withPipelineDelay(withMaxRequestDuration(withInFlightTracking(withReplayRecording(withMaxURLLength(withHostRequired(withHopLimit(withAffinity(withKeepAliveHeader(withCORS(withCacheHeaders(withCompression(h))))))))))))))))
+	}
+	// registered directly to keep the overhead of measured round trips minimal
+	mux.HandleFunc("/ping", func(w http.ResponseWriter, r *http.Request) {
+		ping(w)
+	})
+	handle("/rtt", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rtt(w, r, client)
+	}))
+	handle("/ready", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ready(w)
+	}))
+	handle("/startup", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		startup(w)
+	}))
+	handle("/drain-ready", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		drainReady(w)
+	}))
+	handle("/sleep", graceful(withLastModified(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sleep(w, r)
+	}))))
+	handle("/status", graceful(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status(w, r)
+	})))
+	handle("/error-reuse", graceful(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		errorReuse(w, r)
+	})))
+	handle("/expect-continue", graceful(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		expectContinue(w, r)
+	})))
+	handle("/raw", graceful(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		raw(w, r)
+	})))
+	handle("/cookie", graceful(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cookie(w, r)
+	})))
+	handle("/uptime", graceful(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		uptime(w)
+	})))
+	handle("/multi-status", graceful(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		multiStatus(w, r)
+	})))
+	handle("/conn-age", graceful(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		connAge(w, r)
+	})))
+	handle("/host", graceful(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host(w, r)
+	})))
+	handle("/tls-info", graceful(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tlsInfo(w, r)
+	})))
+	handle("/hold", graceful(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hold(w, r)
+	})))
+	handle("/socket-info", graceful(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		socketInfo(w, r)
+	})))
+	handle("/events", graceful(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		events(w, r)
+	})))
+	handle("/checksum", graceful(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		checksum(w, r)
+	})))
+	handle("/slow-read", graceful(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		slowBodyRead(w, r)
+	})))
+	handle("/provenance", graceful(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		provenance(w, r)
+	})))
+	handle("/grpc-status", graceful(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		grpcStatus(w, r)
+	})))
+	if resolverCache != nil {
+		handle("/dns-cache", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			dnsCacheStats(w)
+		}))
+	}
+	handle("/admin/env", adminOnly(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		adminEnv(w, r)
+	})))
+	handle("/admin/self-connections", adminOnly(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		selfConnections(w, r)
+	})))
+	handle("/admin/flood", adminOnly(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		flood(w, r)
+	})))
+	handle("/admin/replay", adminOnly(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		replay(w, r, client)
+	})))
+	handle("/admin/tls-handshake", adminOnly(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tlsHandshakeCost(w, r)
+	})))
+	handle("/admin/deadlock", graceful(adminOnly(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		deadlock(w, r)
+	}))))
+	handle("/keepalive-info", graceful(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		keepAliveInfo(w, client, server)
+	})))
+	handle("/backpressure", graceful(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		backpressure(w, r)
+	})))
+	handle("/alloc", graceful(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		allocGarbage(w, r)
+	})))
+	handle("/sized", graceful(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sized(w, r)
+	})))
+	handle("/boundary", graceful(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		boundary(w, r)
+	})))
+	handle("/bytes", graceful(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		randomBytes(w, r)
+	})))
+	handle("/informational", graceful(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		informational(w, r)
+	})))
+	handle("/framing", graceful(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		framing(w, r)
+	})))
+	handle("/slow-headers", graceful(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		slowHeaders(w, r)
+	})))
+	handle("/header-casing", graceful(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headerCasing(w, r)
+	})))
+	handle("/close-delimited", graceful(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		closeDelimited(w, r)
+	})))
+	handle("/chunked", graceful(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		chunked(w, r)
+	})))
+	if keepAliveViolations {
+		handle("/violate", graceful(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			violate(w, r)
+		})))
+	}
+	handle("/accept-stats", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		acceptStatsReport(w)
+	}))
+	handle("/pool-stats", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		poolStatsReport(w)
+	}))
+	handle("/proxy-stats", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxyStatsReport(w)
+	}))
+	handle("/metrics", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		metrics(w)
+	}))
+	handle("/saturation", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		saturationReport(w)
+	}))
+	for _, service := range backends {
+		proxyStats[service] = newLatencyStats()
+		handle("/"+service+"/", graceful(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			proxy(service, w, r, client, false)
+		})))
+		handle("/proxy-stream/"+service+"/", graceful(http.StripPrefix("/proxy-stream", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			proxy(service, w, r, client, true)
+		}))))
+	}
+	handle("/fan-out", graceful(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fanOut(w, r, client)
+	})))
+	// add default 404 handler
+	handle("/", graceful(http.NotFoundHandler()))
+}
+
+func shutdown(server *http.Server, listener net.Listener, client *http.Client) {
+	// sleep for shutdownSleepDuration
+	_, _ = fmt.Printf("%v: sleeping for %v before starting shutdown...\n", time.Now().Format(time.RFC3339), shutdownSleepDuration)
+	time.Sleep(shutdownSleepDuration)
+
+	// optionally stop accepting new connections while existing keep-alive
+	// connections are still served normally for a while
+	if acceptStopWindow > 0 {
+		_, _ = fmt.Printf("%v: closing listener, serving existing connections for %v before draining...\n", time.Now().Format(time.RFC3339), acceptStopWindow)
+		if err := listener.Close(); err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "%v: failed to close listener: %v\n", time.Now().Format(time.RFC3339), err)
+		}
+		time.Sleep(acceptStopWindow)
+	}
+
+	// initiate shutdown
+	shutdownInitiated.Store(true)
+	close(shutdownStarted)
+	if gracefulShutdown {
+		// Draining uses two complementary mechanisms:
+		// - SetKeepAlivesEnabled(false) makes the server close every connection
+		//   after its next response. Note that it also closes currently idle
+		//   connections right away, which a client may still race with.
+		// - connectionCloseWriter explicitly sets "Connection: close" on every
+		//   response whose headers have not been written yet, so clients learn
+		//   about the shutdown from the response itself.
+		// Together they ensure that no connection is reused once shutdown began.
+		// For HTTP/2 connections (h2c or TLS), net/http turns both into a
+		// GOAWAY: disabled keep-alives once a connection has no active
+		// streams, and the "Connection: close" header right away.
+		if disableKeepAlivesOnDrain() {
+			server.SetKeepAlivesEnabled(false)
+			keepAlivesDisabled.Store(true)
+		}
+		doGracefulShutdown(listener, client)
+	}
+	_, _ = fmt.Printf("%v: shutting down server...\n", time.Now().Format(time.RFC3339))
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "%v: server shutdown error: %v\n", time.Now().Format(time.RFC3339), err)
+	}
+	_, _ = fmt.Printf("%v: server exited properly\n", time.Now().Format(time.RFC3339))
+}
+
+// disableKeepAlivesOnDrain reports whether to let net/http close all idle
+// connections right away and every other connection after its next response
+// when the drain begins. This is skipped by drain strategies that rely on
+// existing connections to stay open.
+func disableKeepAlivesOnDrain() bool {
+	switch {
+	case faultInjection && dropCloseHeaderRate > 0:
+		// the fault injection deliberately leaves connections open
+		return false
+	case drainBatchSize > 0:
+		// idle connections are closed in batches instead
+		return false
+	case drainCloseListener:
+		// existing keep-alive connections continue to be served
+		return false
+	default:
+		return true
+	}
+}
+
+// drainTimeout returns how long to wait for connections to drain. With
+// DRAIN_P99_MULTIPLIER set, the wait adapts to the workload as a multiple of
+// the observed p99 request latency, falling back to the fixed
+// clientSideIdleTimeout as long as no requests were observed. It is never
+// shorter than MIN_DRAIN_DURATION.
+func drainTimeout() time.Duration {
+	if drainP99Multiplier > 0 && requestStats.count.Load() > 0 {
+		return max(time.Duration(drainP99Multiplier*float64(requestStats.percentile(0.99))), minDrainDuration)
+	}
+	return max(clientSideIdleTimeout, minDrainDuration)
+}
+
+func doGracefulShutdown(listener net.Listener, client *http.Client) {
+	_, _ = fmt.Printf("%v: initiating graceful shutdown...\n", time.Now().Format(time.RFC3339))
+	// let all incoming requests know that shutdown is initiated by
+	// responding with "Connection: close" such that they don't attempt
+	// to reuse connections.
+	gracefulChan := make(chan struct{})
+	// both the timer and the poll loop below may end the drain
+	finishDrain := sync.OnceFunc(func() {
+		close(gracefulChan)
+	})
+	shutdownTimer = atomic.Pointer[time.Timer]{}
+	timeout := drainTimeout()
+	_, _ = fmt.Printf("%v: draining connections for up to %v...\n", time.Now().Format(time.RFC3339), timeout)
+	start := time.Now()
+	deadline := start.Add(timeout)
+	drainDeadline.Store(&deadline)
+	shutdownTimer.Store(time.AfterFunc(timeout, func() {
+		_, _ = fmt.Printf("%v: graceful shutdown timeout reached, forcing exit\n", time.Now().Format(time.RFC3339))
+		finishDrain()
+	}))
+	var deregistered atomic.Bool
+	if deregistrationURL != "" {
+		go awaitDeregistration(client, &deregistered, gracefulChan)
+	}
+	// Check every 500ms if there are active connections and abort the drain period if either
+	// there are no active connections or the shutdown timer has fired.
+	go func() {
+		ticker := time.NewTicker(500 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				n := numConnections.Load()
+				if n == 0 && time.Since(start) < minDrainDuration {
+					// keep serving requests that load balancers are still
+					// routing here although there are no connections yet
+					_, _ = fmt.Printf("%v: no active connections remaining, draining for at least %v\n", time.Now().Format(time.RFC3339), minDrainDuration)
+				} else if n == 0 && deregistrationURL != "" && !deregistered.Load() {
+					_, _ = fmt.Printf("%v: no active connections remaining, waiting for deregistration to be confirmed\n", time.Now().Format(time.RFC3339))
+				} else if n == 0 {
+					_, _ = fmt.Printf("%v: no active connections remaining\n", time.Now().Format(time.RFC3339))
+					finishDrain()
+					return
+				} else {
+					_, _ = fmt.Printf("%v: %d active connections remaining...\n", time.Now().Format(time.RFC3339), n)
+					logSlowestInFlight(5)
+				}
+			case <-gracefulChan:
+				return
+			}
+		}
+	}()
+	if drainBatchSize > 0 {
+		go closeIdleConnsInBatches(gracefulChan)
+	}
+	if drainCloseListener {
+		// Refuse new connections at the TCP level from this point on, so that
+		// load balancers fail over right away, while existing keep-alive
+		// connections continue to be served until they are drained.
+		closeTimer := time.AfterFunc(drainCloseListenerAfter, func() {
+			_, _ = fmt.Printf("%v: closing listener, refusing new connections\n", time.Now().Format(time.RFC3339))
+			if err := listener.Close(); err != nil {
+				_, _ = fmt.Fprintf(os.Stderr, "%v: failed to close listener: %v\n", time.Now().Format(time.RFC3339), err)
+			}
+		})
+		defer closeTimer.Stop()
+	}
+	// wait for graceful shutdown to complete
+	<-gracefulChan
+}
+
+// awaitDeregistration polls DEREGISTRATION_URL every
+// DEREGISTRATION_POLL_INTERVAL through the proxy client until it responds with
+// DEREGISTRATION_STATUS and, if set, a body containing DEREGISTRATION_BODY,
+// confirming that this instance no longer gets traffic routed to it. The
+// drain does not end before that, unless its timeout fires.
+func awaitDeregistration(client *http.Client, deregistered *atomic.Bool, done <-chan struct{}) {
+	ticker := time.NewTicker(deregistrationPollInterval)
+	defer ticker.Stop()
+	for {
+		resp, err := client.Get(deregistrationURL)
+		if err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "%v: deregistration check failed: %v\n", time.Now().Format(time.RFC3339), err)
+		} else {
+			body, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+			_ = resp.Body.Close()
+			if int64(resp.StatusCode) == deregistrationStatus && strings.Contains(string(body), deregistrationBody) {
+				_, _ = fmt.Printf("%v: deregistration confirmed by %v\n", time.Now().Format(time.RFC3339), deregistrationURL)
+				deregistered.Store(true)
+				return
+			}
+		}
+		select {
+		case <-ticker.C:
+		case <-done:
+			return
+		}
+	}
+}
+
+// idleConns tracks the idle connections and since when they are idle, if
+// DRAIN_BATCH_SIZE is set.
+var idleConns = struct {
+	mu    sync.Mutex
+	conns map[net.Conn]time.Time
+}{conns: make(map[net.Conn]time.Time)}
+
+// closeIdleConnsInBatches closes up to drainBatchSize of the longest idle
+// connections every drainBatchInterval until done, so that clients reconnect
+// to other instances gradually instead of all at once. Note that a client may
+// still race with the close by sending a request on the connection just then.
+func closeIdleConnsInBatches(done <-chan struct{}) {
+	ticker := time.NewTicker(drainBatchInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			idleConns.mu.Lock()
+			conns := slices.SortedFunc(maps.Keys(idleConns.conns), func(a, b net.Conn) int {
+				return idleConns.conns[a].Compare(idleConns.conns[b])
+			})
+			conns = conns[:min(int(drainBatchSize), len(conns))]
+			for _, conn := range conns {
+				delete(idleConns.conns, conn)
+				_ = conn.Close()
+			}
+			idleConns.mu.Unlock()
+			if len(conns) > 0 {
+				_, _ = fmt.Printf("%v: closed batch of %d idle connections\n", time.Now().Format(time.RFC3339), len(conns))
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// checkBackend resolves the service name and dials it just like proxy would.
+func checkBackend(service string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), selfTestTimeout)
+	defer cancel()
+	if _, err := net.DefaultResolver.LookupHost(ctx, service); err != nil {
+		return err
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", net.JoinHostPort(service, "80"))
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// selfTest concurrently checks all backends and fails if any of the
+// selfTestRequired backends is unreachable.
+func selfTest() error {
+	var wg sync.WaitGroup
+	errs := make([]error, len(backends))
+	for i, service := range backends {
+		wg.Go(func() {
+			errs[i] = checkBackend(service)
+		})
+	}
+	wg.Wait()
+	var failed []string
+	for i, service := range backends {
+		if errs[i] == nil {
+			_, _ = fmt.Printf("%v: self-test: %v is reachable\n", time.Now().Format(time.RFC3339), service)
+			continue
+		}
+		_, _ = fmt.Fprintf(os.Stderr, "%v: self-test: %v is unreachable: %v\n", time.Now().Format(time.RFC3339), service, errs[i])
+		if slices.Contains(selfTestRequired, service) {
+			failed = append(failed, service)
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("required backends unreachable: %v", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+type dnsCacheEntry struct {
+	addrs   []string
+	expires time.Time
+}
+
+// dnsCache caches host name resolutions of upstream services for ttl, so that
+// new upstream connections don't have to wait for DNS.
+type dnsCache struct {
+	ttl     time.Duration
+	mu      sync.Mutex
+	entries map[string]dnsCacheEntry
+	hits    atomic.Int64
+	misses  atomic.Int64
+}
+
+func newDNSCache(ttl time.Duration) *dnsCache {
+	return &dnsCache{
+		ttl:     ttl,
+		entries: make(map[string]dnsCacheEntry),
+	}
+}
+
+func (c *dnsCache) lookup(ctx context.Context, host string) ([]string, error) {
+	c.mu.Lock()
+	e, ok := c.entries[host]
+	c.mu.Unlock()
+	if ok && time.Now().Before(e.expires) {
+		c.hits.Add(1)
+		return e.addrs, nil
+	}
+	c.misses.Add(1)
+	addrs, err := net.DefaultResolver.LookupHost(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	c.entries[host] = dnsCacheEntry{addrs: addrs, expires: time.Now().Add(c.ttl)}
+	c.mu.Unlock()
+	return addrs, nil
+}
+
+// wrap returns a DialContext function that resolves host names via the cache
+// before dialing them with dial. Addresses are tried starting at a random
+// offset so that new connections spread across all resolved addresses.
+func (c *dnsCache) wrap(dial func(ctx context.Context, network, addr string) (net.Conn, error)) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil || net.ParseIP(host) != nil {
+			return dial(ctx, network, addr)
+		}
+		addrs, err := c.lookup(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		offset := rand.Intn(len(addrs))
+		for i := range addrs {
+			var conn net.Conn
+			conn, err = dial(ctx, network, net.JoinHostPort(addrs[(offset+i)%len(addrs)], port))
+			if err == nil {
+				return conn, nil
+			}
+		}
+		return nil, err
+	}
+}
+
+// delayedDial returns a DialContext function that waits for the configured
+// delay of the host before dialing it with dial, to simulate a slow connect
+// phase independently of the response latency.
+func delayedDial(delays map[string]time.Duration, dial func(ctx context.Context, network, addr string) (net.Conn, error)) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, _, err := net.SplitHostPort(addr)
+		if d := delays[host]; err == nil && d > 0 {
+			t := time.NewTimer(d)
+			defer t.Stop()
+			select {
+			case <-t.C:
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+		return dial(ctx, network, addr)
+	}
+}
+
+// clientConns tracks the connections of the proxy client per host:port.
+var clientConns = struct {
+	mu    sync.Mutex
+	hosts map[string]*hostConnStats
+}{hosts: make(map[string]*hostConnStats)}
+
+type hostConnStats struct {
+	opened int64
+	// reaped counts the connections closed after being idle for
+	// IdleConnTimeout, closed counts all others
+	reaped int64
+	closed int64
+	open   map[*clientConn]struct{}
+}
+
+// clientConn is a connection of the proxy client, see trackClientConns.
+type clientConn struct {
+	net.Conn
+	addr        string
+	idleTimeout time.Duration
+	// lastUse is when data was last read or written in Unix nanoseconds
+	lastUse atomic.Int64
+	// idle is set once a response was read until the next request is
+	// written. This includes connections still streaming a response body.
+	idle   atomic.Bool
+	closed atomic.Bool
+}
+
+func (c *clientConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.lastUse.Store(time.Now().UnixNano())
+		c.idle.Store(true)
+	}
+	return n, err
+}
+
+func (c *clientConn) Write(b []byte) (int, error) {
+	c.idle.Store(false)
+	n, err := c.Conn.Write(b)
+	c.lastUse.Store(time.Now().UnixNano())
+	return n, err
+}
+
+func (c *clientConn) Close() error {
+	if !c.closed.Swap(true) {
+		// the transport starts the idle timer right after the response was
+		// read, so a connection unused for that long was reaped by it
+		reaped := c.idle.Load() && time.Since(time.Unix(0, c.lastUse.Load())) >= c.idleTimeout
+		clientConns.mu.Lock()
+		stats := clientConns.hosts[c.addr]
+		delete(stats.open, c)
+		if reaped {
+			stats.reaped++
+		} else {
+			stats.closed++
+		}
+		clientConns.mu.Unlock()
+		if reaped && verbose {
+			_, _ = fmt.Printf("%v: idle connection to %v reaped after %v\n", time.Now().Format(time.RFC3339), c.addr, c.idleTimeout)
+		}
+	}
+	return c.Conn.Close()
+}
+
+// trackClientConns returns a DialContext function that tracks the connections
+// dialed with dial in clientConns, to make the reaping of idle connections
+// after idleTimeout by the transport visible on /metrics.
+func trackClientConns(idleTimeout time.Duration, dial func(ctx context.Context, network, addr string) (net.Conn, error)) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		cc := &clientConn{Conn: conn, addr: addr, idleTimeout: idleTimeout}
+		cc.lastUse.Store(time.Now().UnixNano())
+		clientConns.mu.Lock()
+		stats, ok := clientConns.hosts[addr]
+		if !ok {
+			stats = &hostConnStats{open: make(map[*clientConn]struct{})}
+			clientConns.hosts[addr] = stats
+		}
+		stats.opened++
+		stats.open[cc] = struct{}{}
+		clientConns.mu.Unlock()
+		return cc, nil
+	}
+}
+
+// metrics exposes the server's connections and requests and the client
+// connection stats in the Prometheus text format. Requests to /ping are not
+// counted, as it is registered without any middleware.
+func metrics(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_, _ = fmt.Fprintln(w, "# HELP http_server_connections Connections currently open.")
+	_, _ = fmt.Fprintln(w, "# TYPE http_server_connections gauge")
+	_, _ = fmt.Fprintf(w, "http_server_connections %d\n", numConnections.Load())
+	_, _ = fmt.Fprintln(w, "# HELP http_server_connections_total Connections accepted.")
+	_, _ = fmt.Fprintln(w, "# TYPE http_server_connections_total counter")
+	_, _ = fmt.Fprintf(w, "http_server_connections_total %d\n", totalConnections.Load())
+	_, _ = fmt.Fprintln(w, "# HELP http_server_requests_total Requests served by route pattern and response status.")
+	_, _ = fmt.Fprintln(w, "# TYPE http_server_requests_total counter")
+	requestCounts.mu.Lock()
+	counts := maps.Clone(requestCounts.counts)
+	requestCounts.mu.Unlock()
+	keys := slices.SortedFunc(maps.Keys(counts), func(a, b requestCountKey) int {
+		return cmp.Or(cmp.Compare(a.pattern, b.pattern), cmp.Compare(a.status, b.status))
+	})
+	for _, key := range keys {
+		_, _ = fmt.Fprintf(w, "http_server_requests_total{path=%q,status=%q} %d\n", key.pattern, key.status, counts[key])
+	}
+	shutdown := 0
+	if shutdownInitiated.Load() {
+		shutdown = 1
+	}
+	saturation, _ := connSaturation()
+	_, _ = fmt.Fprintln(w, "# HELP http_server_connection_saturation Connections currently open relative to SHED_CONN_LIMIT.")
+	_, _ = fmt.Fprintln(w, "# TYPE http_server_connection_saturation gauge")
+	_, _ = fmt.Fprintf(w, "http_server_connection_saturation %g\n", saturation)
+	_, _ = fmt.Fprintln(w, "# HELP http_server_shed_requests_total Requests rejected to shed load.")
+	_, _ = fmt.Fprintln(w, "# TYPE http_server_shed_requests_total counter")
+	_, _ = fmt.Fprintf(w, "http_server_shed_requests_total %d\n", shedRequests.Load())
+	_, _ = fmt.Fprintln(w, "# HELP http_server_shutdown_initiated Whether the graceful shutdown began.")
+	_, _ = fmt.Fprintln(w, "# TYPE http_server_shutdown_initiated gauge")
+	_, _ = fmt.Fprintf(w, "http_server_shutdown_initiated %d\n", shutdown)
+	acceptStats.writeHistogram(w, "http_server_accept_to_first_request_seconds", "Time from accepting connections to reading their first request.")
+	if resolverCache != nil {
+		resolverCache.mu.Lock()
+		entries := len(resolverCache.entries)
+		resolverCache.mu.Unlock()
+		_, _ = fmt.Fprintln(w, "# HELP client_dns_cache_lookups_total Host name lookups of the proxy client by whether DNS_CACHE_TTL cached them.")
+		_, _ = fmt.Fprintln(w, "# TYPE client_dns_cache_lookups_total counter")
+		_, _ = fmt.Fprintf(w, "client_dns_cache_lookups_total{result=\"hit\"} %d\n", resolverCache.hits.Load())
+		_, _ = fmt.Fprintf(w, "client_dns_cache_lookups_total{result=\"miss\"} %d\n", resolverCache.misses.Load())
+		_, _ = fmt.Fprintln(w, "# HELP client_dns_cache_entries Host names currently cached, including expired ones.")
+		_, _ = fmt.Fprintln(w, "# TYPE client_dns_cache_entries gauge")
+		_, _ = fmt.Fprintf(w, "client_dns_cache_entries %d\n", entries)
+	}
+	clientConns.mu.Lock()
+	defer clientConns.mu.Unlock()
+	hosts := slices.Sorted(maps.Keys(clientConns.hosts))
+	_, _ = fmt.Fprintln(w, "# HELP client_connections_opened_total Connections opened by the proxy client.")
+	_, _ = fmt.Fprintln(w, "# TYPE client_connections_opened_total counter")
+	for _, host := range hosts {
+		_, _ = fmt.Fprintf(w, "client_connections_opened_total{host=%q} %d\n", host, clientConns.hosts[host].opened)
+	}
+	_, _ = fmt.Fprintln(w, "# HELP client_connections_closed_total Connections of the proxy client closed, by whether the idle timeout reaped them.")
+	_, _ = fmt.Fprintln(w, "# TYPE client_connections_closed_total counter")
+	for _, host := range hosts {
+		stats := clientConns.hosts[host]
+		_, _ = fmt.Fprintf(w, "client_connections_closed_total{host=%q,reason=\"idle_timeout\"} %d\n", host, stats.reaped)
+		_, _ = fmt.Fprintf(w, "client_connections_closed_total{host=%q,reason=\"other\"} %d\n", host, stats.closed)
+	}
+	_, _ = fmt.Fprintln(w, "# HELP client_connections_idle Connections of the proxy client currently idle in the pool.")
+	_, _ = fmt.Fprintln(w, "# TYPE client_connections_idle gauge")
+	for _, host := range hosts {
+		idle := 0
+		for cc := range clientConns.hosts[host].open {
+			if cc.idle.Load() {
+				idle++
+			}
+		}
+		_, _ = fmt.Fprintf(w, "client_connections_idle{host=%q} %d\n", host, idle)
+	}
+	_, _ = fmt.Fprintln(w, "# HELP client_connections_open Connections of the proxy client currently open.")
+	_, _ = fmt.Fprintln(w, "# TYPE client_connections_open gauge")
+	for _, host := range hosts {
+		_, _ = fmt.Fprintf(w, "client_connections_open{host=%q} %d\n", host, len(clientConns.hosts[host].open))
+	}
+}
+
+func dnsCacheStats(w http.ResponseWriter) {
+	resolverCache.mu.Lock()
+	entries := len(resolverCache.entries)
+	resolverCache.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"ttl":     resolverCache.ttl.String(),
+		"entries": entries,
+		"hits":    resolverCache.hits.Load(),
+		"misses":  resolverCache.misses.Load(),
+	})
+}
+
+// loadRate returns the requests per second that the load pattern asks for at
+// elapsed time into the current run.
+func loadRate(elapsed time.Duration) float64 {
+	phase := float64(elapsed%loadPeriod) / float64(loadPeriod)
+	switch loadPattern {
+	case "constant":
+		return float64(loadAmplitude)
+	case "sine":
+		return float64(loadAmplitude) * (1 + math.Sin(2*math.Pi*phase)) / 2
+	case "step":
+		if phase < 0.5 {
+			return float64(loadAmplitude)
+		}
+		return 0
+	default:
+		return 0
+	}
+}
+
+// shutdownWhenIdle requests shutdown once there were neither connections nor
+// requests other than probes, scrapes and admin requests for
+// maxIdleBeforeShutdown.
+func shutdownWhenIdle() {
+	lastRequest.CompareAndSwap(0, startTime.UnixNano())
+	// a tiny MAX_IDLE_BEFORE_SHUTDOWN would make the interval non-positive
+	ticker := time.NewTicker(max(min(maxIdleBeforeShutdown/10, time.Second), time.Millisecond))
+	defer ticker.Stop()
+	for range ticker.C {
+		idle := time.Since(time.Unix(0, lastRequest.Load()))
+		if numConnections.Load() == 0 && idle >= maxIdleBeforeShutdown {
+			_, _ = fmt.Printf("%v: no connections or requests for %v, shutting down\n", time.Now().Format(time.RFC3339), idle.Round(time.Millisecond))
+			requestShutdown()
+			return
+		}
+	}
+}
+
+// replayHeader marks the requests issued by /admin/replay, so that they are not
+// recorded again.
+const replayHeader = "X-Replay"
+
+type recordedRequest struct {
+	at     time.Time
+	method string
+	uri    string
+}
+
+// recording holds the arrival times of up to replayRecordMax requests to paths
+// starting with replayRecordPath.
+var recording = struct {
+	mu       sync.Mutex
+	requests []recordedRequest
+}{}
+
+func withReplayRecording(next http.Handler) http.Handler {
+	if replayRecordPath == "" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, replayRecordPath) && r.Header.Get(replayHeader) == "" {
+			recording.mu.Lock()
+			if int64(len(recording.requests)) < replayRecordMax {
+				recording.requests = append(recording.requests, recordedRequest{at: time.Now(), method: r.Method, uri: r.URL.RequestURI()})
+			}
+			recording.mu.Unlock()
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// replay plays back the recorded requests against this server with the same
+// inter-arrival gaps, divided by the optional speed factor, and reports once
+// all of them completed. With clear=true, the recording is discarded instead.
+func replay(w http.ResponseWriter, r *http.Request, client *http.Client) {
+	if r.URL.Query().Get("clear") == "true" {
+		recording.mu.Lock()
+		n := len(recording.requests)
+		recording.requests = nil
+		recording.mu.Unlock()
+		_, _ = fmt.Fprintf(w, "Discarded %d recorded requests\n", n)
+		return
+	}
+	speed := 1.0
+	if speedStr := r.URL.Query().Get("speed"); speedStr != "" {
+		var err error
+		speed, err = strconv.ParseFloat(speedStr, 64)
+		if err != nil || speed <= 0 {
+			http.Error(w, "Invalid speed parameter\n", http.StatusBadRequest)
+			return
+		}
+	}
+	recording.mu.Lock()
+	requests := slices.Clone(recording.requests)
+	recording.mu.Unlock()
+	if len(requests) == 0 {
+		http.Error(w, "No requests recorded\n", http.StatusConflict)
+		return
+	}
+	_, _ = fmt.Printf("%v: replaying %d requests at speed %v\n", time.Now().Format(time.RFC3339), len(requests), speed)
+	var wg sync.WaitGroup
+	var sent, failed atomic.Int64
+	start := time.Now()
+replay:
+	for _, rr := range requests {
+		offset := time.Duration(float64(rr.at.Sub(requests[0].at)) / speed)
+		select {
+		case <-time.After(time.Until(start.Add(offset))):
+		case <-r.Context().Done():
+			break replay
+		}
+		sent.Add(1)
+		wg.Go(func() {
+			req, err := http.NewRequestWithContext(r.Context(), rr.method, selfURL+rr.uri, http.NoBody)
+			if err != nil {
+				failed.Add(1)
+				return
+			}
+			req.Header.Set(replayHeader, "true")
+			resp, err := client.Do(req)
+			if err != nil {
+				failed.Add(1)
+				return
+			}
+			_, _ = io.Copy(io.Discard, resp.Body)
+			_ = resp.Body.Close()
+		})
+	}
+	wg.Wait()
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"recorded": len(requests),
+		"sent":     sent.Load(),
+		"failed":   failed.Load(),
+		"duration": time.Since(start).String(),
+	})
+}
+
+// flood sends tiny requests to path (default /ping) of this server at a
+// fixed total rate over a fixed number of keep-alive connections for a while
+// and reports the throughput and latencies, so that the cost of serving
+// requests on warm connections can be measured without connection setup.
+func flood(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	intParam := func(name string, def, limit int) (int, error) {
+		v := q.Get(name)
+		if v == "" {
+			return def, nil
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > limit {
+			return 0, fmt.Errorf("invalid %v parameter", name)
+		}
+		return n, nil
+	}
+	conns, err := intParam("conns", 4, 100)
+	if err != nil {
+		http.Error(w, "Invalid conns parameter\n", http.StatusBadRequest)
+		return
+	}
+	rate, err := intParam("rate", 1000, 100000)
+	if err != nil {
+		http.Error(w, "Invalid rate parameter\n", http.StatusBadRequest)
+		return
+	}
+	duration := 5 * time.Second
+	if durationStr := q.Get("duration"); durationStr != "" {
+		duration, err = time.ParseDuration(durationStr)
+		if err != nil || duration <= 0 || duration > time.Minute {
+			http.Error(w, "Invalid duration parameter\n", http.StatusBadRequest)
+			return
+		}
+	}
+	target := selfURL + cmp.Or(q.Get("path"), "/ping")
+	// a dedicated transport limited to conns connections, all kept alive
+	transport := &http.Transport{MaxConnsPerHost: conns, MaxIdleConnsPerHost: conns}
+	defer transport.CloseIdleConnections()
+	client := &http.Client{Transport: transport}
+	stats := newLatencyStats()
+	var newConns atomic.Int64
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if !info.Reused {
+				newConns.Add(1)
+			}
+		},
+	}
+	ctx, cancel := context.WithTimeout(httptrace.WithClientTrace(r.Context(), trace), duration)
+	defer cancel()
+	_, _ = fmt.Printf("%v: flooding %v with %d req/s over %d connections for %v\n", time.Now().Format(time.RFC3339), target, rate, conns, duration)
+	// every connection gets its own share of the rate
+	interval := time.Duration(conns) * time.Second / time.Duration(rate)
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := range conns {
+		wg.Go(func() {
+			// stagger the connections over one interval
+			next := start.Add(interval * time.Duration(i) / time.Duration(conns))
+			for {
+				select {
+				case <-time.After(time.Until(next)):
+				case <-ctx.Done():
+					return
+				}
+				next = next.Add(interval)
+				req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, http.NoBody)
+				if err != nil {
+					stats.errors.Add(1)
+					return
+				}
+				reqStart := time.Now()
+				resp, err := client.Do(req)
+				if err != nil {
+					if ctx.Err() == nil {
+						stats.errors.Add(1)
+					}
+					continue
+				}
+				_, _ = io.Copy(io.Discard, resp.Body)
+				_ = resp.Body.Close()
+				stats.record(time.Since(reqStart))
+			}
+		})
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"target":         target,
+		"connections":    conns,
+		"newConnections": newConns.Load(),
+		"targetRate":     rate,
+		"achievedRate":   float64(stats.count.Load()) / elapsed.Seconds(),
+		"duration":       elapsed.String(),
+		"latency":        stats.summary(),
+	})
+}
+
+// generateLoad sends requests to loadTarget following loadPattern until ctx is done.
+func generateLoad(ctx context.Context, client *http.Client) {
+	_, _ = fmt.Printf("%v: generating %v load of up to %d req/s against %v\n", time.Now().Format(time.RFC3339), loadPattern, loadAmplitude, loadTarget)
+	const tick = 100 * time.Millisecond
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+	start := time.Now()
+	var pending float64
+	for {
+		select {
+		case <-ticker.C:
+			pending += loadRate(time.Since(start)) * tick.Seconds()
+			for ; pending >= 1; pending-- {
+				go func() {
+					req, err := http.NewRequestWithContext(ctx, http.MethodGet, loadTarget, http.NoBody)
+					if err != nil {
+						return
+					}
+					resp, err := client.Do(req)
+					if err != nil {
+						if ctx.Err() == nil {
+							_, _ = fmt.Fprintf(os.Stderr, "%v: load request failed: %v\n", time.Now().Format(time.RFC3339), err)
+						}
+						return
+					}
+					_, _ = io.Copy(io.Discard, resp.Body)
+					_ = resp.Body.Close()
+				}()
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// connStates holds the current state of every open connection and since when
+// idle connections are idle.
+var connStates = struct {
+	mu        sync.Mutex
+	states    map[net.Conn]http.ConnState
+	idleSince map[net.Conn]time.Time
+}{states: make(map[net.Conn]http.ConnState), idleSince: make(map[net.Conn]time.Time)}
+
+// idleReuseStats holds the latencyStats of how long connections were idle
+// before clients reused them.
+var idleReuseStats = newLatencyStats()
+
+// idleCloseStats holds the latencyStats of how long connections were idle
+// before they were closed. Clients with a full pool close connections right
+// away, others once their idle timeout expired.
+var idleCloseStats = newLatencyStats()
+
+func trackConnState(conn net.Conn, state http.ConnState) {
+	connStates.mu.Lock()
+	prevState := connStates.states[conn]
+	if since, ok := connStates.idleSince[conn]; ok && state != http.StateIdle {
+		delete(connStates.idleSince, conn)
+		if state == http.StateActive {
+			idleReuseStats.record(time.Since(since))
+		} else {
+			idleCloseStats.record(time.Since(since))
+		}
+	}
+	switch state {
+	case http.StateClosed, http.StateHijacked:
+		delete(connStates.states, conn)
+	case http.StateIdle:
+		connStates.idleSince[conn] = time.Now()
+		connStates.states[conn] = state
+	default:
+		connStates.states[conn] = state
+	}
+	connStates.mu.Unlock()
+	if hc, ok := underlyingConn[*halfCloseConn](conn); ok {
+		hc.active.Store(state == http.StateActive)
+	}
+	trackPipelining(conn, state, prevState)
+	if connCloseEvents && (state == http.StateClosed || state == http.StateHijacked) {
+		logConnClosed(conn, state, prevState)
+	}
+	if connTimelines {
+		recordConnTimeline(conn, state)
+	}
+	switch state {
+	case http.StateNew:
+		numConnections.Add(1)
+		totalConnections.Add(1)
+		if maxConnsPerIP > 0 && connsPerIP.add(conn, 1) > maxConnsPerIP {
+			_, _ = fmt.Printf("%v: closing connection from %v, limit of %d connections per IP reached\n", time.Now().Format(time.RFC3339), conn.RemoteAddr(), maxConnsPerIP)
+			_ = conn.Close()
+		}
+	case http.StateClosed, http.StateHijacked:
+		decrementConnections(conn)
+		if maxConnsPerIP > 0 {
+			connsPerIP.add(conn, -1)
+		}
+	default:
+		// do nothing
+	}
+	if drainBatchSize > 0 {
+		idleConns.mu.Lock()
+		if state == http.StateIdle {
+			idleConns.conns[conn] = time.Now()
+		} else {
+			delete(idleConns.conns, conn)
+		}
+		idleConns.mu.Unlock()
+	}
+}
+
+// decrementConnections decrements numConnections but never below zero, since
+// the drain waits for it to reach zero. An underflow means a connection was
+// closed without having been counted as new and is logged as a bug.
+func decrementConnections(conn net.Conn) {
+	for {
+		n := numConnections.Load()
+		if n <= 0 {
+			_, _ = fmt.Fprintf(os.Stderr, "%v: warning: connection count underflow on close of connection from %v\n", time.Now().Format(time.RFC3339), conn.RemoteAddr())
+			return
+		}
+		if numConnections.CompareAndSwap(n, n-1) {
+			return
+		}
+	}
+}
+
+// ipConnCounter counts the open connections per remote IP.
+type ipConnCounter struct {
+	mu     sync.Mutex
+	counts map[string]int64
+}
+
+var connsPerIP = ipConnCounter{counts: make(map[string]int64)}
+
+// add adds delta to the count of the connection's remote IP and returns the new count.
+func (c *ipConnCounter) add(conn net.Conn, delta int64) int64 {
+	ip, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		ip = conn.RemoteAddr().String()
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := c.counts[ip] + delta
+	if n <= 0 {
+		delete(c.counts, ip)
+	} else {
+		c.counts[ip] = n
+	}
+	return n
+}
+
+type connSnapshot struct {
+	Time        string `json:"time"`
+	Connections int32  `json:"connections"`
+	New         int    `json:"new"`
+	Active      int    `json:"active"`
+	Idle        int    `json:"idle"`
+	InFlight    int    `json:"inFlight"`
+	Requests    int64  `json:"requests"`
+	Draining    bool   `json:"draining"`
+}
+
+func takeConnSnapshot() connSnapshot {
+	snapshot := connSnapshot{
+		Time:        time.Now().Format(time.RFC3339Nano),
+		Connections: numConnections.Load(),
+		Requests:    requestStats.count.Load(),
+		Draining:    drainDeadline.Load() != nil,
+	}
+	connStates.mu.Lock()
+	for _, state := range connStates.states {
+		switch state {
+		case http.StateNew:
+			snapshot.New++
+		case http.StateActive:
+			snapshot.Active++
+		case http.StateIdle:
+			snapshot.Idle++
+		default:
+			// closed and hijacked connections are not tracked
+		}
+	}
+	connStates.mu.Unlock()
+	inFlight.mu.Lock()
+	snapshot.InFlight = len(inFlight.requests)
+	inFlight.mu.Unlock()
+	return snapshot
+}
+
+// startConnSnapshots appends a JSON line with a connSnapshot to the file
+// at path every interval. The returned function writes a last snapshot and
+// closes the file.
+func startConnSnapshots(path string, interval time.Duration) (func(), error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	enc := json.NewEncoder(f)
+	write := func() {
+		if err := enc.Encode(takeConnSnapshot()); err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "%v: failed to write connection snapshot: %v\n", time.Now().Format(time.RFC3339), err)
+		}
+	}
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				write()
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return func() {
+		close(stop)
+		<-stopped
+		write()
+		if err := f.Close(); err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "%v: failed to close %v: %v\n", time.Now().Format(time.RFC3339), path, err)
+		}
+	}, nil
+}
+
+// noDelayListener sets TCP_NODELAY on accepted connections. Go disables
+// Nagle's algorithm by default; enabling it shows its latency impact on small
+// requests when combined with delayed ACKs.
+type noDelayListener struct {
+	net.Listener
+	noDelay bool
+}
+
+func (l *noDelayListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		if err = tcpConn.SetNoDelay(l.noDelay); err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "%v: failed to set TCP_NODELAY: %v\n", time.Now().Format(time.RFC3339), err)
+		}
+	}
+	return conn, nil
+}
+
+// halfCloseListener wraps accepted connections in halfCloseConns.
+type halfCloseListener struct {
+	net.Listener
+}
+
+func (l *halfCloseListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &halfCloseConn{Conn: conn}, nil
+}
+
+// halfCloseConn detects clients that half-close the connection, i.e. send a
+// FIN after their request but before they read the whole response. With
+// HALF_CLOSE=log, the event and how much of the response was still written
+// afterward is logged, with HALF_CLOSE=close the connection is closed right
+// away instead of delivering the rest of the response.
+type halfCloseConn struct {
+	net.Conn
+	// active is set while a request is served, see trackConnState
+	active     atomic.Bool
+	halfClosed atomic.Bool
+	// bytesAfter counts the bytes written after the half-close
+	bytesAfter atomic.Int64
+}
+
+func (c *halfCloseConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if errors.Is(err, io.EOF) && c.active.Load() && !c.halfClosed.Swap(true) {
+		_, _ = fmt.Printf("%v: client %v half-closed the connection while its request is served\n", time.Now().Format(time.RFC3339), c.RemoteAddr())
+		if halfCloseMode == "close" {
+			_ = c.Conn.Close()
+		}
+	}
+	return n, err
+}
+
+func (c *halfCloseConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if c.halfClosed.Load() {
+		c.bytesAfter.Add(int64(n))
+	}
+	return n, err
+}
+
+func (c *halfCloseConn) Close() error {
+	if c.halfClosed.Load() {
+		_, _ = fmt.Printf("%v: closing half-closed connection from %v after writing %d more bytes\n", time.Now().Format(time.RFC3339), c.RemoteAddr(), c.bytesAfter.Load())
+	}
+	return c.Conn.Close()
+}
+
+// pipelineListener wraps accepted connections in pipelineConns.
+type pipelineListener struct {
+	net.Listener
+}
+
+func (l *pipelineListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &pipelineConn{Conn: conn}, nil
 }
 
-func (w *connectionCloseWriter) Flush() {
-	if f, ok := w.ResponseWriter.(http.Flusher); ok {
-		f.Flush()
+// pipelineConn detects HTTP/1.1 pipelining, i.e. clients sending requests
+// without waiting for the responses to the previous ones. A request that
+// becomes active on an idle connection without anything read from the
+// connection in between was already buffered, so it was pipelined. Requests
+// that arrive while the previous one is still served go unnoticed, since
+// net/http reads ahead into its own buffer.
+type pipelineConn struct {
+	net.Conn
+	// readsSinceIdle counts the reads returning data since the connection
+	// went idle
+	readsSinceIdle atomic.Int64
+	// pipelined is set while a pipelined request is served
+	pipelined atomic.Bool
+	count     atomic.Int64
+}
+
+func (c *pipelineConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.readsSinceIdle.Add(1)
 	}
+	return n, err
 }
 
-func (w *connectionCloseWriter) ReadFrom(src io.Reader) (int64, error) {
-	w.injectHeader()
-	if rf, ok := w.ResponseWriter.(io.ReaderFrom); ok {
-		return rf.ReadFrom(src)
+// trackPipelining updates the pipelining state of conn when it enters state
+// after prevState.
+func trackPipelining(conn net.Conn, state, prevState http.ConnState) {
+	pc, ok := underlyingConn[*pipelineConn](conn)
+	if !ok {
+		return
+	}
+	switch state {
+	case http.StateIdle:
+		pc.pipelined.Store(false)
+		pc.readsSinceIdle.Store(0)
+	case http.StateActive:
+		if prevState == http.StateIdle && pc.readsSinceIdle.Load() == 0 {
+			pc.pipelined.Store(true)
+			n := pc.count.Add(1)
+			if pipelineLog {
+				_, _ = fmt.Printf("%v: client %v pipelined a request, %d so far on this connection\n", time.Now().Format(time.RFC3339), conn.RemoteAddr(), n)
+			}
+		}
+	default:
+		// do nothing
 	}
-	// Fallback: copy manually via Write (which won't re-inject thanks to the guard).
-	return io.Copy(w.ResponseWriter, src)
 }
 
-func graceful(next http.Handler) http.Handler {
-	if !gracefulShutdown {
+// withPipelineDelay delays the responses to pipelined requests by
+// PIPELINE_DELAY. net/http serves pipelined requests one after another, so the
+// client gets its responses strictly in order, each later than it could be.
+func withPipelineDelay(next http.Handler) http.Handler {
+	if pipelineDelay <= 0 {
 		return next
 	}
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		cw := &connectionCloseWriter{
-			ResponseWriter: w,
+		if pc, ok := underlyingConn[*pipelineConn](connInfoFrom(r.Context()).conn); ok && pc.pipelined.Load() {
+			w.Header().Set("X-Pipelined", "true")
+			select {
+			case <-time.After(pipelineDelay):
+			case <-r.Context().Done():
+				return
+			}
 		}
-		next.ServeHTTP(cw, r)
+		next.ServeHTTP(w, r)
 	})
 }
 
-func buildInverseDiscreteCDF(values []time.Duration, probabilities []float32) func() time.Duration {
-	cdf := make([]float32, len(probabilities))
-	var cumProb float32 = 0.0
-	for i, p := range probabilities {
-		cumProb += p
-		cdf[i] = cumProb
+// countingListener wraps accepted connections in countingConns.
+type countingListener struct {
+	net.Listener
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
 	}
-	return func() time.Duration {
-		r := rand.Float32()
-		for i, cp := range cdf {
-			if r <= cp {
-				return values[i]
-			}
-		}
-		return values[len(values)-1]
+	return &countingConn{Conn: conn, accepted: time.Now()}, nil
+}
+
+// countingConn counts the bytes transferred over a connection and remembers
+// how it ended, for logConnClosed.
+type countingConn struct {
+	net.Conn
+	accepted time.Time
+	info     atomic.Pointer[connInfo]
+	bytesIn  atomic.Int64
+	bytesOut atomic.Int64
+	// readErr is the last error reading from the connection, except for
+	// timeouts, which net/http uses to abort its background reads
+	readErr atomic.Pointer[error]
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.bytesIn.Add(int64(n))
+	if err != nil && !errors.Is(err, os.ErrDeadlineExceeded) {
+		c.readErr.Store(&err)
 	}
+	return n, err
 }
 
-func sleep(w http.ResponseWriter, r *http.Request) {
-	lo, hi := 50*time.Millisecond, 1*time.Second
-	minD, maxD := r.URL.Query().Get("min"), r.URL.Query().Get("max")
-	pdf := r.URL.Query().Get("pdf")
-	if pdf != "" {
-		var values []time.Duration
-		var probabilities []float32
-		pairs := strings.Split(pdf, ",")
-		var totalProb float32 = 0.0
-		for _, pair := range pairs {
-			parts := strings.SplitN(pair, ":", 2)
-			if len(parts) != 2 {
-				_, _ = fmt.Fprintf(os.Stderr, "%v: invalid pdf pair: %v\n", time.Now().Format(time.RFC3339), pair)
-				http.Error(w, "Invalid pdf parameter\n", http.StatusBadRequest)
-				return
-			}
-			durStr, probStr := parts[0], parts[1]
-			dur, err := time.ParseDuration(durStr)
-			if err != nil {
-				_, _ = fmt.Fprintf(os.Stderr, "%v: failed to parse duration in pdf: %v\n", time.Now().Format(time.RFC3339), err)
-				http.Error(w, "Failed to parse duration in pdf\n", http.StatusBadRequest)
-				return
-			}
-			var prob float32
-			_, err = fmt.Sscanf(probStr, "%f", &prob)
-			if err != nil {
-				_, _ = fmt.Fprintf(os.Stderr, "%v: failed to parse probability in pdf: %v\n", time.Now().Format(time.RFC3339), err)
-				http.Error(w, "Failed to parse probability in pdf\n", http.StatusBadRequest)
-				return
-			}
-			values = append(values, dur)
-			probabilities = append(probabilities, prob)
-			totalProb += prob
-		}
-		if totalProb <= 0.0 {
-			_, _ = fmt.Fprintf(os.Stderr, "%v: total probability in pdf must be greater than 0\n", time.Now().Format(time.RFC3339))
-			http.Error(w, "Total probability in pdf must be greater than 0\n", http.StatusBadRequest)
-			return
-		}
-		invTotalProb := float32(1.0) / totalProb
-		for i := range probabilities {
-			probabilities[i] *= invTotalProb
-		}
-		inverseCDF := buildInverseDiscreteCDF(values, probabilities)
-		sleepDuration := inverseCDF()
-		time.Sleep(sleepDuration)
-		_, _ = fmt.Fprintf(w, "Slept for %v\n", sleepDuration)
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.bytesOut.Add(int64(n))
+	return n, err
+}
+
+type connClosedEvent struct {
+	Time     string `json:"time"`
+	Event    string `json:"event"`
+	Remote   string `json:"remote"`
+	Requests int64  `json:"requests"`
+	BytesIn  int64  `json:"bytesIn"`
+	BytesOut int64  `json:"bytesOut"`
+	Duration string `json:"duration"`
+	Reason   string `json:"reason"`
+}
+
+// logConnClosed logs a connClosedEvent as JSON, summarizing the lifetime of
+// the connection that just entered state.
+func logConnClosed(conn net.Conn, state, prevState http.ConnState) {
+	cc, ok := underlyingConn[*countingConn](conn)
+	if !ok {
 		return
 	}
-	if d, err := time.ParseDuration(minD); err == nil {
-		lo = d
-	} else if minD != "" {
-		_, _ = fmt.Fprintf(os.Stderr, "%v: NewRequest err: %v\n", time.Now().Format(time.RFC3339), err)
-		http.Error(w, "Failed to parse min duration\n", http.StatusBadRequest)
+	event := connClosedEvent{
+		Time:     time.Now().Format(time.RFC3339),
+		Event:    "connection closed",
+		Remote:   conn.RemoteAddr().String(),
+		BytesIn:  cc.bytesIn.Load(),
+		BytesOut: cc.bytesOut.Load(),
+		Duration: time.Since(cc.accepted).Round(time.Millisecond).String(),
+	}
+	if ci := cc.info.Load(); ci != nil {
+		event.Requests = ci.requests.Load()
+	}
+	readErr := cc.readErr.Load()
+	switch {
+	case state == http.StateHijacked:
+		event.Event = "connection hijacked"
+		event.Reason = "hijacked"
+	case readErr != nil && errors.Is(*readErr, io.EOF):
+		event.Reason = "client close"
+	case readErr != nil && errors.Is(*readErr, syscall.ECONNRESET):
+		event.Reason = "client reset"
+	case shutdownInitiated.Load():
+		event.Reason = "shutdown"
+	case prevState == http.StateIdle:
+		event.Reason = "idle timeout"
+	case readErr != nil && !errors.Is(*readErr, net.ErrClosed):
+		event.Reason = "error: " + (*readErr).Error()
+	default:
+		event.Reason = "server close"
+	}
+	b, _ := json.Marshal(event)
+	_, _ = fmt.Println(string(b))
+}
+
+type connTimelineEvent struct {
+	Time     string          `json:"time"`
+	Event    string          `json:"event"`
+	Conn     uint64          `json:"conn"`
+	Remote   string          `json:"remote"`
+	Accepted string          `json:"accepted"`
+	Duration string          `json:"duration"`
+	Events   []timelineEvent `json:"events"`
+	Dropped  int             `json:"dropped,omitempty"`
+}
+
+// recordConnTimeline adds idle periods and the end of a connection to its
+// timeline, logging the whole timeline as JSON once the connection is gone.
+func recordConnTimeline(conn net.Conn, state http.ConnState) {
+	cc, ok := underlyingConn[*countingConn](conn)
+	if !ok {
 		return
 	}
-	if d, err := time.ParseDuration(maxD); err == nil {
-		hi = d
-	} else if maxD != "" {
-		_, _ = fmt.Fprintf(os.Stderr, "%v: NewRequest err: %v\n", time.Now().Format(time.RFC3339), err)
-		http.Error(w, "Failed to parse max duration\n", http.StatusBadRequest)
+	ci := cc.info.Load()
+	if ci == nil {
 		return
 	}
-	sleepDuration := lo + time.Duration(rand.Int63n(int64(hi-lo+1)))
-	time.Sleep(sleepDuration)
-	_, _ = fmt.Fprintf(w, "Slept for %v\n", sleepDuration)
+	switch state {
+	case http.StateIdle:
+		ci.addTimelineEvent("idle", "", false)
+		return
+	case http.StateClosed:
+		ci.addTimelineEvent("close", "", true)
+	case http.StateHijacked:
+		ci.addTimelineEvent("hijacked", "", true)
+	default:
+		return
+	}
+	ci.timeline.mu.Lock()
+	event := connTimelineEvent{
+		Time:     time.Now().Format(time.RFC3339),
+		Event:    "connection timeline",
+		Conn:     ci.id,
+		Remote:   conn.RemoteAddr().String(),
+		Accepted: ci.accepted.Format(time.RFC3339Nano),
+		Duration: time.Since(ci.accepted).Round(time.Millisecond).String(),
+		Events:   ci.timeline.events,
+		Dropped:  ci.timeline.dropped,
+	}
+	b, _ := json.Marshal(event)
+	ci.timeline.mu.Unlock()
+	_, _ = fmt.Println(string(b))
 }
 
-func forwardTraceHeaders(src, dest http.Header) {
-	traceHeaders := []string{
-		"X-Request-ID",
-		"X-B3-Traceid",
-		"X-B3-Spanid",
-		"X-B3-Parentspanid",
-		"X-B3-Sampled",
-		"X-B3-Flags",
-		"X-Ot-Span-Context",
-		"Traceparent",
-		"Tracestate",
-		"B3",
+// socketBufferListener sets the socket receive and send buffer sizes of
+// accepted connections, leaving those that are not positive at the OS default.
+type socketBufferListener struct {
+	net.Listener
+	readBuffer  int
+	writeBuffer int
+}
+
+func (l *socketBufferListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
 	}
-	for _, h := range traceHeaders {
-		if v := src.Get(h); v != "" {
-			dest.Set(h, v)
+	if tcpConn, ok := underlyingConn[*net.TCPConn](conn); ok {
+		if l.readBuffer > 0 {
+			if err = tcpConn.SetReadBuffer(l.readBuffer); err != nil {
+				_, _ = fmt.Fprintf(os.Stderr, "%v: failed to set read buffer: %v\n", time.Now().Format(time.RFC3339), err)
+			}
+		}
+		if l.writeBuffer > 0 {
+			if err = tcpConn.SetWriteBuffer(l.writeBuffer); err != nil {
+				_, _ = fmt.Fprintf(os.Stderr, "%v: failed to set write buffer: %v\n", time.Now().Format(time.RFC3339), err)
+			}
 		}
 	}
+	return conn, nil
 }
 
-func proxy(service string, w http.ResponseWriter, r *http.Request, client *http.Client) {
-	req, err := http.NewRequest(r.Method, "http://"+service+"/", http.NoBody)
-	if err != nil {
-		_, _ = fmt.Fprintf(os.Stderr, "%v: NewRequest err: %v\n", time.Now().Format(time.RFC3339), err)
-		http.Error(w, "Failed to create request\n", http.StatusInternalServerError)
+// underlyingConn returns the first connection of type T in the chain of
+// connection wrappers starting at conn.
+func underlyingConn[T net.Conn](conn net.Conn) (T, bool) {
+	for {
+		if c, ok := conn.(T); ok {
+			return c, true
+		}
+		switch c := conn.(type) {
+		case *tls.Conn:
+			conn = c.NetConn()
+		case *prefaceSniffConn:
+			conn = c.Conn
+		case *countingConn:
+			conn = c.Conn
+		case *halfCloseConn:
+			conn = c.Conn
+		case *pipelineConn:
+			conn = c.Conn
+		default:
+			var zero T
+			return zero, false
+		}
+	}
+}
+
+// socketInfo reports the effective socket buffer sizes of the connection
+// serving the request, as read back from the kernel.
+func socketInfo(w http.ResponseWriter, r *http.Request) {
+	tcpConn, ok := underlyingConn[*net.TCPConn](connInfoFrom(r.Context()).conn)
+	if !ok {
+		http.Error(w, "Not a TCP connection\n", http.StatusInternalServerError)
 		return
 	}
-	forwardTraceHeaders(r.Header, req.Header)
-	req.URL.Path = r.URL.Path[1+len(service):]
-	req.URL.RawQuery = r.URL.RawQuery
-	resp, err := client.Do(req)
+	raw, err := tcpConn.SyscallConn()
 	if err != nil {
-		_, _ = fmt.Fprintf(os.Stderr, "%v: request to envoy failed: %v\n", time.Now().Format(time.RFC3339), err)
-		http.Error(w, "Request to envoy failed\n", http.StatusBadGateway)
+		http.Error(w, "Failed to access socket\n", http.StatusInternalServerError)
 		return
 	}
-	defer resp.Body.Close()
-	w.WriteHeader(resp.StatusCode)
-	if _, err = io.Copy(w, resp.Body); err != nil {
-		_, _ = fmt.Fprintf(os.Stderr, "%v: failed to copy response body: %v\n", time.Now().Format(time.RFC3339), err)
+	var readBuffer, writeBuffer int
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		if readBuffer, sockErr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_RCVBUF); sockErr != nil {
+			return
+		}
+		writeBuffer, sockErr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_SNDBUF)
+	})
+	if err = cmp.Or(err, sockErr); err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "%v: failed to read socket options: %v\n", time.Now().Format(time.RFC3339), err)
+		http.Error(w, "Failed to read socket options\n", http.StatusInternalServerError)
 		return
 	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		// Linux doubles the requested sizes to account for bookkeeping overhead
+		"readBuffer":            readBuffer,
+		"writeBuffer":           writeBuffer,
+		"configuredReadBuffer":  socketReadBuffer,
+		"configuredWriteBuffer": socketWriteBuffer,
+		"connRequests":          connInfoFrom(r.Context()).requests.Load(),
+	})
 }
 
-func ready(w http.ResponseWriter) {
-	if shutdownInitiated.Load() {
-		w.Header().Set("Connection", "close")
-		w.WriteHeader(http.StatusServiceUnavailable)
-	} else {
-		_, _ = w.Write([]byte("OK"))
-	}
+// http2Preface is what HTTP/2 clients with prior knowledge send first.
+const http2Preface = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+
+// prefaceSniffListener logs connections of HTTP/2 clients with prior knowledge,
+// which net/http rejects as long as h2c is disabled.
+type prefaceSniffListener struct {
+	net.Listener
 }
 
-func status(w http.ResponseWriter, r *http.Request) {
-	codeStr := r.URL.Query().Get("code")
-	if codeStr == "" {
-		http.Error(w, "Missing code parameter\n", http.StatusBadRequest)
-		return
+func (l *prefaceSniffListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
 	}
-	var code int
-	_, err := fmt.Sscanf(codeStr, "%d", &code)
-	if err != nil || code < 100 || code > 599 {
-		http.Error(w, "Invalid code parameter\n", http.StatusBadRequest)
-		return
+	return &prefaceSniffConn{Conn: conn}, nil
+}
+
+type prefaceSniffConn struct {
+	net.Conn
+	sniffed bool
+}
+
+func (c *prefaceSniffConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if !c.sniffed && n > 0 {
+		c.sniffed = true
+		if bytes.HasPrefix(b[:n], []byte(http2Preface[:min(n, len(http2Preface))])) {
+			_, _ = fmt.Fprintf(os.Stderr, "%v: HTTP/2 prior knowledge connection from %v, but h2c is disabled (set H2C=true)\n", time.Now().Format(time.RFC3339), c.RemoteAddr())
+		}
 	}
-	w.WriteHeader(code)
-	_, _ = fmt.Fprintf(w, "Returned status code %d\n", code)
+	return n, err
 }
 
-func registerHandlers(mux *http.ServeMux, client *http.Client) {
-	mux.Handle("/ready", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		ready(w)
-	}))
-	mux.Handle("/sleep", graceful(withLastModified(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		sleep(w, r)
-	}))))
-	mux.Handle("/status", graceful(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		status(w, r)
-	})))
-	mux.Handle("/envoy/", graceful(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		proxy("envoy", w, r, client)
-	})))
-	mux.Handle("/nginx/", graceful(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		proxy("nginx", w, r, client)
-	})))
-	mux.Handle("/varnish/", graceful(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		proxy("varnish", w, r, client)
-	})))
-	mux.Handle("/node-demo/", graceful(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		proxy("node-demo", w, r, client)
-	})))
-	mux.Handle("/java-demo/", graceful(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		proxy("java-demo", w, r, client)
-	})))
-	// add default 404 handler
-	mux.Handle("/", graceful(http.NotFoundHandler()))
+// onceCloseListener makes closing the listener more than once a no-op.
+type onceCloseListener struct {
+	net.Listener
+	once sync.Once
+	err  error
 }
 
-func shutdown(server *http.Server) {
-	// sleep for shutdownSleepDuration
-	_, _ = fmt.Printf("%v: sleeping for %v before starting shutdown...\n", time.Now().Format(time.RFC3339), shutdownSleepDuration)
-	time.Sleep(shutdownSleepDuration)
+func (l *onceCloseListener) Close() error {
+	l.once.Do(func() {
+		l.err = l.Listener.Close()
+	})
+	return l.err
+}
 
-	// initiate shutdown
-	shutdownInitiated.Store(true)
-	if gracefulShutdown {
-		doGracefulShutdown()
+// delayedListener delays handing out every accepted connection to model a
+// server whose accept queue is backed up.
+type delayedListener struct {
+	net.Listener
+	delay     time.Duration
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newDelayedListener(l net.Listener, delay time.Duration) *delayedListener {
+	return &delayedListener{
+		Listener: l,
+		delay:    delay,
+		closed:   make(chan struct{}),
 	}
-	_, _ = fmt.Printf("%v: shutting down server...\n", time.Now().Format(time.RFC3339))
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-	defer cancel()
-	if err := server.Shutdown(ctx); err != nil {
-		_, _ = fmt.Fprintf(os.Stderr, "%v: server shutdown error: %v\n", time.Now().Format(time.RFC3339), err)
+}
+
+func (l *delayedListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	// Don't let the delay hold up shutdown once the server closed the listener.
+	select {
+	case <-time.After(l.delay):
+		return conn, nil
+	case <-l.closed:
+		_ = conn.Close()
+		return nil, net.ErrClosed
 	}
-	_, _ = fmt.Printf("%v: server exited properly\n", time.Now().Format(time.RFC3339))
 }
 
-func doGracefulShutdown() {
-	_, _ = fmt.Printf("%v: initiating graceful shutdown...\n", time.Now().Format(time.RFC3339))
-	// let all incoming requests know that shutdown is initiated by
-	// responding with "Connection: close" such that they don't attempt
-	// to reuse connections.
-	gracefulChan := make(chan struct{})
-	shutdownTimer = atomic.Pointer[time.Timer]{}
-	shutdownTimer.Store(time.AfterFunc(clientSideIdleTimeout, func() {
-		_, _ = fmt.Printf("%v: graceful shutdown timeout reached, forcing exit\n", time.Now().Format(time.RFC3339))
-		close(gracefulChan)
-	}))
-	// Check every 500ms if there are active connections and abort the drain period if either
-	// there are no active connections or the shutdown timer has fired.
-	go func() {
-		ticker := time.NewTicker(500 * time.Millisecond)
-		defer ticker.Stop()
-		for {
-			select {
-			case <-ticker.C:
-				n := numConnections.Load()
-				if n == 0 {
-					_, _ = fmt.Printf("%v: no active connections remaining\n", time.Now().Format(time.RFC3339))
-					close(gracefulChan)
+func (l *delayedListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.closed)
+	})
+	return l.Listener.Close()
+}
+
+// warmPool establishes warmPoolSize idle connections to each of the
+// warmPoolServices (all backends by default) by sending that many concurrent
+// HEAD requests, so that the first proxied requests don't pay for connection
+// setup. Note that the connections are only kept for the client's
+// IdleConnTimeout if they are not used.
+func warmPool(client *http.Client) {
+	services := warmPoolServices
+	if len(services) == 0 {
+		services = backends
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), warmPoolTimeout)
+	defer cancel()
+	var warmed atomic.Int64
+	var wg sync.WaitGroup
+	for _, service := range services {
+		for range warmPoolSize {
+			wg.Go(func() {
+				req, err := http.NewRequestWithContext(ctx, http.MethodHead, "http://"+service+"/", http.NoBody)
+				if err != nil {
 					return
-				} else {
-					_, _ = fmt.Printf("%v: %d active connections remaining...\n", time.Now().Format(time.RFC3339), n)
 				}
-			case <-gracefulChan:
-				return
-			}
+				resp, err := client.Do(req)
+				if err != nil {
+					_, _ = fmt.Fprintf(os.Stderr, "%v: failed to warm connection to %v: %v\n", time.Now().Format(time.RFC3339), service, err)
+					return
+				}
+				_, _ = io.Copy(io.Discard, resp.Body)
+				_ = resp.Body.Close()
+				warmed.Add(1)
+			})
 		}
-	}()
-	// wait for graceful shutdown to complete
-	<-gracefulChan
+	}
+	wg.Wait()
+	_, _ = fmt.Printf("%v: warmed %d of %d upstream connections\n", time.Now().Format(time.RFC3339), warmed.Load(), int64(len(services))*warmPoolSize)
 }
 
 func main() {
+	startTime = time.Now()
+
+	for _, service := range backends {
+		if strings.ContainsAny(service, "/:?# ") {
+			_, _ = fmt.Fprintf(os.Stderr, "%v: invalid BACKENDS: %v\n", time.Now().Format(time.RFC3339), service)
+			os.Exit(1)
+		}
+	}
+	if shutdownSleepDuration < 0 || clientSideIdleTimeout < 0 {
+		_, _ = fmt.Fprintf(os.Stderr, "%v: invalid SHUTDOWN_SLEEP %v or DRAIN_TIMEOUT %v\n", time.Now().Format(time.RFC3339), shutdownSleepDuration, clientSideIdleTimeout)
+		os.Exit(1)
+	}
+
+	if shedThreshold > 0 && shedLimit < shedThreshold {
+		_, _ = fmt.Fprintf(os.Stderr, "%v: invalid SHED_CONN_LIMIT %d below SHED_CONN_THRESHOLD %d\n", time.Now().Format(time.RFC3339), shedLimit, shedThreshold)
+		os.Exit(1)
+	}
+	if sleepPerConnection < 0 {
+		_, _ = fmt.Fprintf(os.Stderr, "%v: invalid SLEEP_PER_CONNECTION %v\n", time.Now().Format(time.RFC3339), sleepPerConnection)
+		os.Exit(1)
+	}
+	if maxSleepSample <= 0 {
+		_, _ = fmt.Fprintf(os.Stderr, "%v: invalid MAX_SLEEP_SAMPLE %v\n", time.Now().Format(time.RFC3339), maxSleepSample)
+		os.Exit(1)
+	}
+
+	for _, algorithm := range compressionAlgorithms {
+		if _, ok := compressors[algorithm]; !ok || compressionLevel < 1 || compressionLevel > 9 {
+			_, _ = fmt.Fprintf(os.Stderr, "%v: invalid compression %v with level %d\n", time.Now().Format(time.RFC3339), algorithm, compressionLevel)
+			os.Exit(1)
+		}
+	}
+
+	if startupSelfTest {
+		if err := selfTest(); err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "%v: self-test failed: %v\n", time.Now().Format(time.RFC3339), err)
+			os.Exit(1)
+		}
+	}
+
 	transport := http.DefaultTransport.(*http.Transport).Clone()
 	// Tune the Transport to allow more concurrent connections.
 	// This is to exacerbate the problems we will demonstrate later.
@@ -335,45 +5494,154 @@ func main() {
 	// - Tomcat with 60s timeout
 	// - Jetty with 30s timeout
 	transport.IdleConnTimeout = 4 * time.Second
+	transport.DisableCompression = proxyCompressionPassthrough
+	if dnsCacheTTL > 0 {
+		resolverCache = newDNSCache(dnsCacheTTL)
+		transport.DialContext = resolverCache.wrap(transport.DialContext)
+	}
+	if len(dialDelays) > 0 {
+		transport.DialContext = delayedDial(dialDelays, transport.DialContext)
+	}
+	transport.DialContext = trackClientConns(transport.IdleConnTimeout, transport.DialContext)
 	client := &http.Client{
 		Transport: transport,
 	}
 	server := &http.Server{
-		Addr: ":8080",
-		ConnState: func(conn net.Conn, state http.ConnState) {
-			switch state {
-			case http.StateNew:
-				numConnections.Add(1)
-			case http.StateClosed, http.StateHijacked:
-				numConnections.Add(-1)
-			default:
-				// do nothing
-			}
-		},
+		Addr:        listenAddr,
+		ConnState:   trackConnState,
+		ConnContext: withConnInfo,
+	}
+	if h2c {
+		// serve HTTP/2 over cleartext connections to clients with prior
+		// knowledge next to HTTP/1.1
+		server.Protocols = new(http.Protocols)
+		server.Protocols.SetHTTP1(true)
+		server.Protocols.SetUnencryptedHTTP2(true)
+		_, _ = fmt.Printf("%v: h2c enabled\n", time.Now().Format(time.RFC3339))
+	}
+	if tlsCertFile != "" || tlsKeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(tlsCertFile, tlsKeyFile)
+		if err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "%v: failed to load TLS certificate: %v\n", time.Now().Format(time.RFC3339), err)
+			os.Exit(1)
+		}
+		server.TLSConfig = &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			// without tickets, TLS sessions can't be resumed
+			SessionTicketsDisabled: !tlsSessionTickets,
+		}
+		if server.Protocols != nil {
+			// keep negotiating HTTP/2 over TLS next to h2c
+			server.Protocols.SetHTTP2(true)
+		}
+	}
+	if http2MaxConcurrentStreams > 0 {
+		server.HTTP2 = &http.HTTP2Config{MaxConcurrentStreams: int(http2MaxConcurrentStreams)}
+	}
+	if servesHTTP2(server) {
+		// net/http defaults to 250 concurrent streams per connection
+		_, _ = fmt.Printf("%v: HTTP/2 max concurrent streams: %d\n", time.Now().Format(time.RFC3339), cmp.Or(http2MaxConcurrentStreams, 250))
 	}
 	mux := http.NewServeMux()
-	server.Handler = mux
-	registerHandlers(mux, client)
+	server.Handler = withRequestLimit(mux)
+	registerHandlers(mux, client, server)
 
 	// set up signal handling for graceful shutdown
 	sigs := make(chan os.Signal, 1)
-	done := make(chan struct{}, 1)
 	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT)
 	go func() {
 		sig := <-sigs
 		_, _ = fmt.Printf("%v: received signal: %v\n", time.Now().Format(time.RFC3339), sig)
-		done <- struct{}{}
+		requestShutdown()
 	}()
 
 	// start server
+	listener, err := net.Listen("tcp", server.Addr)
+	if err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "%v: listen error: %v\n", time.Now().Format(time.RFC3339), err)
+		os.Exit(1)
+	}
+	_, _ = fmt.Printf("%v: listening on %v with TCP_NODELAY=%v\n", time.Now().Format(time.RFC3339), listener.Addr(), tcpNoDelay)
+	listener = &noDelayListener{Listener: listener, noDelay: tcpNoDelay}
+	if connCloseEvents || connTimelines {
+		listener = &countingListener{Listener: listener}
+	}
+	switch halfCloseMode {
+	case "":
+	case "log", "close":
+		listener = &halfCloseListener{Listener: listener}
+	default:
+		_, _ = fmt.Fprintf(os.Stderr, "%v: invalid HALF_CLOSE: %v\n", time.Now().Format(time.RFC3339), halfCloseMode)
+		os.Exit(1)
+	}
+	if pipelineLog || pipelineDelay > 0 {
+		listener = &pipelineListener{Listener: listener}
+	}
+	if socketReadBuffer > 0 || socketWriteBuffer > 0 {
+		listener = &socketBufferListener{Listener: listener, readBuffer: int(socketReadBuffer), writeBuffer: int(socketWriteBuffer)}
+	}
+	tlsEnabled := server.TLSConfig != nil
+	if !h2c && !tlsEnabled {
+		listener = &prefaceSniffListener{Listener: listener}
+	}
+	if acceptDelay > 0 {
+		listener = newDelayedListener(listener, acceptDelay)
+	}
+	// the listener may be closed early during shutdown and then again by server.Shutdown
+	listener = &onceCloseListener{Listener: listener}
 	go func() {
-		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		var err error
+		if tlsEnabled {
+			err = server.ServeTLS(listener, "", "")
+		} else {
+			err = server.Serve(listener)
+		}
+		if err != nil && !errors.Is(err, http.ErrServerClosed) && !errors.Is(err, net.ErrClosed) {
 			_, _ = fmt.Fprintf(os.Stderr, "%v: server error: %v\n", time.Now().Format(time.RFC3339), err)
 		}
 	}()
 
-	// wait for signal to shutdown
-	<-done
+	// warm up while already listening, /startup reports 503 until done
+	if warmPoolSize > 0 {
+		warmPool(client)
+	}
+	initialized.Store(true)
+	_, _ = fmt.Printf("%v: startup complete after %v\n", time.Now().Format(time.RFC3339), time.Since(startTime).Round(time.Millisecond))
+
+	if watchdogThreshold > 0 {
+		go watchdog()
+	}
+	if maxIdleBeforeShutdown > 0 {
+		go shutdownWhenIdle()
+	}
+
+	stopSnapshots := func() {}
+	if connSnapshotFile != "" {
+		if connSnapshotInterval <= 0 {
+			_, _ = fmt.Fprintf(os.Stderr, "%v: invalid CONN_SNAPSHOT_INTERVAL: %v\n", time.Now().Format(time.RFC3339), connSnapshotInterval)
+			os.Exit(1)
+		}
+		stopSnapshots, err = startConnSnapshots(connSnapshotFile, connSnapshotInterval)
+		if err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "%v: failed to open %v: %v\n", time.Now().Format(time.RFC3339), connSnapshotFile, err)
+			os.Exit(1)
+		}
+	}
+
+	loadCtx, stopLoad := context.WithCancel(context.Background())
+	if loadPattern != "" {
+		if !slices.Contains([]string{"constant", "sine", "step"}, loadPattern) || loadPeriod <= 0 {
+			_, _ = fmt.Fprintf(os.Stderr, "%v: invalid load pattern %v with period %v\n", time.Now().Format(time.RFC3339), loadPattern, loadPeriod)
+			os.Exit(1)
+		}
+		go generateLoad(loadCtx, client)
+	}
+
+	// wait for signal (or a self-initiated request) to shutdown
+	<-shutdownRequested
+	stopLoad()
+	stopSelfConnections()
 
-	shutdown(server)
+	shutdown(server, listener, client)
+	stopSnapshots()
 }
@@ -0,0 +1,901 @@
+package main
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// set assigns v to the package variable at p for the duration of the test.
+func set[T any](t *testing.T, p *T, v T) {
+	t.Helper()
+	old := *p
+	*p = v
+	t.Cleanup(func() { *p = old })
+}
+
+// resetShutdown restores the shutdown state after the test, so that shutdown
+// can be run again by the next one.
+func resetShutdown(t *testing.T) {
+	t.Helper()
+	set(t, &shutdownSleepDuration, 0)
+	t.Cleanup(func() {
+		shutdownInitiated.Store(false)
+		keepAlivesDisabled.Store(false)
+		shutdownStarted = make(chan struct{})
+		drainDeadline.Store(nil)
+	})
+}
+
+// startServer starts handler on a test server that tracks its connections
+// like main does. With h2c, it serves HTTP/2 with prior knowledge as well.
+func startServer(t *testing.T, handler http.Handler, h2c bool) *httptest.Server {
+	t.Helper()
+	ts := httptest.NewUnstartedServer(handler)
+	ts.Config.ConnState = trackConnState
+	ts.Config.ConnContext = withConnInfo
+	// shutdown may close the listener before server.Shutdown does
+	ts.Listener = &onceCloseListener{Listener: ts.Listener}
+	if h2c {
+		ts.Config.Protocols = new(http.Protocols)
+		ts.Config.Protocols.SetHTTP1(true)
+		ts.Config.Protocols.SetUnencryptedHTTP2(true)
+	}
+	ts.Start()
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+// waitFor polls cond until it is true or fails the test after timeout.
+func waitFor(t *testing.T, timeout time.Duration, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met in time")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// connIDHandler responds with the ID of the connection that served the request
+// and, for /block, signals entered and blocks until release is closed.
+func connIDHandler(entered chan<- struct{}, release <-chan struct{}) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/block" {
+			entered <- struct{}{}
+			<-release
+		}
+		_, _ = fmt.Fprint(w, connInfoFrom(r.Context()).id)
+	})
+}
+
+// getConnID requests url and returns the ID of the connection that served it.
+func getConnID(client *http.Client, url string) (string, *http.Response, error) {
+	resp, err := client.Get(url)
+	if err != nil {
+		return "", nil, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	body, err := io.ReadAll(resp.Body)
+	return string(body), resp, err
+}
+
+func TestNoReuseAfterShutdown(t *testing.T) {
+	resetShutdown(t)
+	set(t, &gracefulShutdown, true)
+	set(t, &clientSideIdleTimeout, 10*time.Second)
+	entered, release := make(chan struct{}, 1), make(chan struct{})
+	ts := startServer(t, graceful(connIDHandler(entered, release)), false)
+	client := &http.Client{Transport: &http.Transport{}}
+	t.Cleanup(client.CloseIdleConnections)
+
+	id, _, err := getConnID(client, ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// in flight on the same keep-alive connection when shutdown begins
+	type result struct {
+		id   string
+		resp *http.Response
+		err  error
+	}
+	blocked := make(chan result, 1)
+	go func() {
+		id, resp, err := getConnID(client, ts.URL+"/block")
+		blocked <- result{id, resp, err}
+	}()
+	<-entered
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		shutdown(ts.Config, ts.Listener, client)
+	}()
+	waitFor(t, time.Second, shutdownInitiated.Load)
+	close(release)
+	res := <-blocked
+	if res.err != nil {
+		t.Fatal(res.err)
+	}
+	if res.id != id {
+		t.Fatalf("in-flight request served on connection %v, want %v", res.id, id)
+	}
+	if !res.resp.Close {
+		t.Error("in-flight request finished without Connection: close")
+	}
+
+	newID, _, err := getConnID(client, ts.URL)
+	if err == nil && newID == id {
+		t.Errorf("connection %v reused after shutdown began", id)
+	}
+	<-done
+}
+
+func TestH2CShutdown(t *testing.T) {
+	tests := []struct {
+		name               string
+		drainCloseListener bool
+	}{
+		{name: "keep-alives disabled"},
+		// keep-alives stay enabled, only Connection: close signals the drain
+		{name: "listener closed", drainCloseListener: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetShutdown(t)
+			set(t, &gracefulShutdown, true)
+			set(t, &drainCloseListener, tt.drainCloseListener)
+			// only ends early if all connections are gone
+			set(t, &clientSideIdleTimeout, 10*time.Second)
+			ts := startServer(t, graceful(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				_, _ = w.Write([]byte(r.Proto))
+			})), true)
+			protocols := new(http.Protocols)
+			protocols.SetUnencryptedHTTP2(true)
+			client := &http.Client{Transport: &http.Transport{Protocols: protocols}}
+			t.Cleanup(client.CloseIdleConnections)
+
+			get := func() *http.Response {
+				t.Helper()
+				resp, err := client.Get(ts.URL)
+				if err != nil {
+					t.Fatal(err)
+				}
+				_ = resp.Body.Close()
+				if resp.StatusCode != http.StatusOK || resp.ProtoMajor != 2 {
+					t.Fatalf("got %v %v, want 200 over HTTP/2", resp.Proto, resp.StatusCode)
+				}
+				return resp
+			}
+			get()
+
+			done := make(chan struct{})
+			start := time.Now()
+			go func() {
+				defer close(done)
+				shutdown(ts.Config, ts.Listener, client)
+			}()
+			waitFor(t, time.Second, shutdownInitiated.Load)
+			if resp := get(); resp.Header.Get("Connection") != "" {
+				t.Errorf("got Connection: %v in HTTP/2 response", resp.Header.Get("Connection"))
+			}
+			// the GOAWAY closes the connection, which ends the drain early
+			select {
+			case <-done:
+			case <-time.After(5 * time.Second):
+				t.Fatal("HTTP/2 connection was not drained")
+			}
+			if d := time.Since(start); d >= clientSideIdleTimeout {
+				t.Errorf("drain took %v, want the connection to be closed before the timeout", d)
+			}
+		})
+	}
+}
+
+func TestConnectionCountNeverNegative(t *testing.T) {
+	ts := startServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/hijack" {
+			conn, _, err := http.NewResponseController(w).Hijack()
+			if err == nil {
+				_ = conn.Close()
+			}
+		}
+	}), false)
+	waitFor(t, time.Second, func() bool { return numConnections.Load() == 0 })
+	var negative atomic.Bool
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				if numConnections.Load() < 0 {
+					negative.Store(true)
+				}
+				time.Sleep(time.Millisecond)
+			}
+		}
+	}()
+
+	// send writes request on a new connection and reads until the server closes it
+	send := func(request string) {
+		t.Helper()
+		conn, err := net.Dial("tcp", ts.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() { _ = conn.Close() }()
+		if request != "" {
+			_, _ = io.WriteString(conn, request)
+			_, _ = io.Copy(io.Discard, conn)
+		}
+	}
+	tests := []struct {
+		name    string
+		request string
+	}{
+		{name: "hijacked", request: "GET /hijack HTTP/1.1\r\nHost: localhost\r\n\r\n"},
+		{name: "malformed request", request: "NOT HTTP\r\n\r\n"},
+		{name: "closed by client right away"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			send(tt.request)
+			waitFor(t, time.Second, func() bool { return numConnections.Load() == 0 })
+		})
+	}
+	t.Run("closed after hijack", func(t *testing.T) {
+		// net/http never reports StateClosed after StateHijacked, but the
+		// count must not underflow if it did
+		conn, peer := net.Pipe()
+		defer func() { _ = peer.Close() }()
+		trackConnState(conn, http.StateNew)
+		trackConnState(conn, http.StateHijacked)
+		_ = conn.Close()
+		trackConnState(conn, http.StateClosed)
+		if n := numConnections.Load(); n != 0 {
+			t.Errorf("got %d connections, want 0", n)
+		}
+	})
+	if negative.Load() {
+		t.Error("connection count went negative")
+	}
+}
+
+func TestSetForwardedHeaders(t *testing.T) {
+	tests := []struct {
+		name       string
+		url        string
+		remoteAddr string
+		prior      []string
+		wantFor    string
+		wantProto  string
+	}{
+		{name: "create", url: "http://example.com/", remoteAddr: "192.0.2.1:1234", wantFor: "192.0.2.1", wantProto: "http"},
+		{name: "append", url: "http://example.com/", remoteAddr: "192.0.2.1:1234", prior: []string{"203.0.113.7"}, wantFor: "203.0.113.7, 192.0.2.1", wantProto: "http"},
+		{name: "append to chain", url: "http://example.com/", remoteAddr: "192.0.2.1:1234", prior: []string{"203.0.113.7, 198.51.100.2"}, wantFor: "203.0.113.7, 198.51.100.2, 192.0.2.1", wantProto: "http"},
+		{name: "append to multiple headers", url: "http://example.com/", remoteAddr: "192.0.2.1:1234", prior: []string{"203.0.113.7", "198.51.100.2"}, wantFor: "203.0.113.7, 198.51.100.2, 192.0.2.1", wantProto: "http"},
+		{name: "IPv6 without port", url: "http://example.com/", remoteAddr: "[2001:db8::1]:1234", wantFor: "2001:db8::1", wantProto: "http"},
+		{name: "address without port", url: "http://example.com/", remoteAddr: "192.0.2.1", wantFor: "192.0.2.1", wantProto: "http"},
+		{name: "TLS", url: "https://example.com/", remoteAddr: "192.0.2.1:1234", wantFor: "192.0.2.1", wantProto: "https"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, tt.url, nil)
+			r.RemoteAddr = tt.remoteAddr
+			for _, v := range tt.prior {
+				r.Header.Add("X-Forwarded-For", v)
+			}
+			dest := make(http.Header)
+			setForwardedHeaders(r, dest)
+			if got := dest.Values("X-Forwarded-For"); len(got) != 1 || got[0] != tt.wantFor {
+				t.Errorf("got X-Forwarded-For %q, want %q", got, tt.wantFor)
+			}
+			if got := dest.Get("X-Forwarded-Proto"); got != tt.wantProto {
+				t.Errorf("got X-Forwarded-Proto %q, want %q", got, tt.wantProto)
+			}
+			if got := dest.Get("X-Forwarded-Host"); got != "example.com" {
+				t.Errorf("got X-Forwarded-Host %q, want example.com", got)
+			}
+		})
+	}
+}
+
+func TestProxyRoundTrip(t *testing.T) {
+	type received struct {
+		method, path, body string
+		header             http.Header
+	}
+	upstream := make(chan received, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		upstream <- received{r.Method, r.URL.Path, string(body), r.Header}
+		w.Header().Set("X-Upstream", "yes")
+		w.Header().Set("Connection", "X-Upstream-Hop")
+		w.Header().Set("X-Upstream-Hop", "secret")
+		w.WriteHeader(http.StatusCreated)
+	}))
+	t.Cleanup(backend.Close)
+	set(t, &proxyStats, map[string]*latencyStats{"backend": newLatencyStats()})
+	// resolve the backend service to the test server
+	transport := &http.Transport{DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, network, backend.Listener.Addr().String())
+	}}
+	t.Cleanup(transport.CloseIdleConnections)
+	client := &http.Client{Transport: transport}
+	front := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxy("backend", w, r, client, false)
+	}))
+	t.Cleanup(front.Close)
+
+	req, err := http.NewRequest(http.MethodPost, front.URL+"/backend/echo", strings.NewReader("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "text/plain")
+	req.Header.Set("X-Custom", "custom")
+	req.Header.Set("Connection", "X-Hop")
+	req.Header.Set("X-Hop", "secret")
+	req.Header.Set("Keep-Alive", "timeout=5")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+
+	got := <-upstream
+	if got.method != http.MethodPost || got.path != "/echo" || got.body != "hello" {
+		t.Errorf("backend got %v %v with body %q, want POST /echo with body %q", got.method, got.path, got.body, "hello")
+	}
+	for name, want := range map[string]string{"Content-Type": "text/plain", "X-Custom": "custom", "X-Hop": "", "Keep-Alive": ""} {
+		if v := got.header.Get(name); v != want {
+			t.Errorf("backend got %v: %q, want %q", name, v, want)
+		}
+	}
+	if resp.StatusCode != http.StatusCreated || resp.Header.Get("X-Upstream") != "yes" {
+		t.Errorf("got %v with X-Upstream: %q, want 201 with the upstream's headers", resp.Status, resp.Header.Get("X-Upstream"))
+	}
+	if v := resp.Header.Get("X-Upstream-Hop"); v != "" {
+		t.Errorf("got hop-by-hop header X-Upstream-Hop: %q from upstream", v)
+	}
+}
+
+func TestSleepClientDisconnect(t *testing.T) {
+	inFlightCount := func() int {
+		inFlight.mu.Lock()
+		defer inFlight.mu.Unlock()
+		return len(inFlight.requests)
+	}
+	handler := withInFlightTracking(http.HandlerFunc(sleep))
+	for _, query := range []string{"min=10s&max=10s", "min=10s&max=10s&chunks=5"} {
+		t.Run(query, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			r := httptest.NewRequest(http.MethodGet, "/sleep?"+query, nil).WithContext(ctx)
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				handler.ServeHTTP(httptest.NewRecorder(), r)
+			}()
+			waitFor(t, time.Second, func() bool { return inFlightCount() == 1 })
+			cancel()
+			select {
+			case <-done:
+			case <-time.After(time.Second):
+				t.Fatal("handler kept sleeping after the client went away")
+			}
+			if n := inFlightCount(); n != 0 {
+				t.Errorf("got %d requests in flight, want 0", n)
+			}
+		})
+	}
+}
+
+// listenerClosed reports whether ts refuses new connections.
+func listenerClosed(ts *httptest.Server) bool {
+	conn, err := net.Dial("tcp", ts.Listener.Addr().String())
+	if err != nil {
+		return true
+	}
+	_ = conn.Close()
+	return false
+}
+
+func TestDrainCloseListenerServesExistingConnections(t *testing.T) {
+	resetShutdown(t)
+	set(t, &gracefulShutdown, true)
+	set(t, &drainCloseListener, true)
+	set(t, &drainCloseListenerAfter, 0)
+	set(t, &clientSideIdleTimeout, 10*time.Second)
+	ts := startServer(t, graceful(connIDHandler(nil, nil)), false)
+	client := &http.Client{Transport: &http.Transport{}}
+	t.Cleanup(client.CloseIdleConnections)
+
+	id, _, err := getConnID(client, ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		shutdown(ts.Config, ts.Listener, client)
+	}()
+	waitFor(t, time.Second, func() bool { return listenerClosed(ts) })
+	got, resp, err := getConnID(client, ts.URL)
+	if err != nil {
+		t.Fatalf("existing connection not served after the listener closed: %v", err)
+	}
+	if got != id {
+		t.Errorf("served on connection %v, want existing connection %v", got, id)
+	}
+	if !resp.Close {
+		t.Error("response during drain without Connection: close")
+	}
+	<-done
+}
+
+func TestAcceptStopWindowOrdering(t *testing.T) {
+	resetShutdown(t)
+	set(t, &gracefulShutdown, true)
+	set(t, &acceptStopWindow, time.Second)
+	set(t, &clientSideIdleTimeout, 10*time.Second)
+	ts := startServer(t, graceful(connIDHandler(nil, nil)), false)
+	client := &http.Client{Transport: &http.Transport{}}
+	t.Cleanup(client.CloseIdleConnections)
+
+	id, _, err := getConnID(client, ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		shutdown(ts.Config, ts.Listener, client)
+	}()
+
+	// first, new connections are refused
+	waitFor(t, time.Second, func() bool { return listenerClosed(ts) })
+	closed := time.Now()
+	// then, existing connections are served normally for the window
+	for range 3 {
+		got, resp, err := getConnID(client, ts.URL)
+		if err != nil {
+			t.Fatalf("existing connection not served while accepting is stopped: %v", err)
+		}
+		if got != id || resp.Close {
+			t.Errorf("served on connection %v with Connection: close %v, want keep-alive connection %v", got, resp.Close, id)
+		}
+	}
+	if shutdownInitiated.Load() {
+		t.Fatal("drain began before the requests within the window were served")
+	}
+	// and only after it, the drain begins
+	waitFor(t, 2*time.Second, shutdownInitiated.Load)
+	if d := time.Since(closed); d < acceptStopWindow-100*time.Millisecond {
+		t.Errorf("drain began %v after the listener closed, want %v", d, acceptStopWindow)
+	}
+	<-done
+}
+
+func TestCacheHeadersETag(t *testing.T) {
+	set(t, &compressionAlgorithms, []string{"gzip"})
+	release := make(chan struct{})
+	ts := startServer(t, withCacheHeaders(withCompression(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, strings.Repeat("cacheable ", 100))
+		if r.URL.Path == "/stream" {
+			_ = http.NewResponseController(w).Flush()
+			<-release
+		}
+	}))), false)
+	// the transport must neither add Accept-Encoding nor decompress
+	client := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+	t.Cleanup(client.CloseIdleConnections)
+
+	get := func(path, acceptEncoding, ifNoneMatch string) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, ts.URL+path+"?etag=true", nil)
+		if acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { _ = resp.Body.Close() })
+		return resp
+	}
+	identity, gzipped := get("/", "", ""), get("/", "gzip", "")
+	if gzipped.Header.Get("Content-Encoding") != "gzip" {
+		t.Fatalf("got Content-Encoding %q, want gzip", gzipped.Header.Get("Content-Encoding"))
+	}
+	if identity.Header.Get("ETag") == gzipped.Header.Get("ETag") {
+		t.Errorf("got the same ETag %v for identity and gzip", identity.Header.Get("ETag"))
+	}
+	if v := gzipped.Header.Get("Vary"); v != "Accept-Encoding" {
+		t.Errorf("got Vary %q, want Accept-Encoding", v)
+	}
+	if resp := get("/", "gzip", gzipped.Header.Get("ETag")); resp.StatusCode != http.StatusNotModified {
+		t.Errorf("got %v for matching If-None-Match, want 304", resp.Status)
+	}
+	if resp := get("/", "", gzipped.Header.Get("ETag")); resp.StatusCode != http.StatusOK {
+		t.Errorf("got %v for the ETag of another coding, want 200", resp.Status)
+	}
+
+	// flushing streams the response without an ETag
+	stream := get("/stream", "", "")
+	defer close(release)
+	if stream.Header.Get("ETag") != "" {
+		t.Errorf("got ETag %v for a flushed response", stream.Header.Get("ETag"))
+	}
+	b := make([]byte, 9)
+	if _, err := io.ReadFull(stream.Body, b); err != nil || string(b) != "cacheable" {
+		t.Errorf("got %q, %v before the handler finished, want the flushed body", b, err)
+	}
+}
+
+func TestCompressionKeepsExplicitContentLength(t *testing.T) {
+	set(t, &compressionAlgorithms, []string{"gzip"})
+	ts := startServer(t, withCompression(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := strings.Repeat("framed ", 100)
+		if r.URL.Path == "/framed" {
+			w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		}
+		_, _ = io.WriteString(w, body)
+	})), false)
+	client := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+	t.Cleanup(client.CloseIdleConnections)
+
+	for path, wantEncoding := range map[string]string{"/framed": "", "/": "gzip"} {
+		req, _ := http.NewRequest(http.MethodGet, ts.URL+path, nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+		if got := resp.Header.Get("Content-Encoding"); got != wantEncoding {
+			t.Errorf("%v: got Content-Encoding %q, want %q", path, got, wantEncoding)
+		}
+		if wantEncoding == "" && resp.ContentLength != 700 {
+			t.Errorf("%v: got Content-Length %d, want 700", path, resp.ContentLength)
+		}
+	}
+}
+
+func TestCompressionCodings(t *testing.T) {
+	set(t, &compressionAlgorithms, []string{"gzip", "deflate"})
+	body := strings.Repeat("compressed ", 100)
+	ts := startServer(t, withCompression(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, body)
+	})), false)
+	client := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+	t.Cleanup(client.CloseIdleConnections)
+
+	for coding, newReader := range map[string]func(io.Reader) (io.ReadCloser, error){
+		"gzip": func(r io.Reader) (io.ReadCloser, error) { return gzip.NewReader(r) },
+		// strict decoders reject raw DEFLATE without the zlib header
+		"deflate": zlib.NewReader,
+	} {
+		req, _ := http.NewRequest(http.MethodGet, ts.URL, nil)
+		req.Header.Set("Accept-Encoding", coding)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := resp.Header.Get("Content-Encoding"); got != coding {
+			t.Errorf("got Content-Encoding %q, want %q", got, coding)
+		}
+		zr, err := newReader(resp.Body)
+		if err != nil {
+			t.Fatalf("%v: %v", coding, err)
+		}
+		b, err := io.ReadAll(zr)
+		_ = resp.Body.Close()
+		if err != nil || string(b) != body {
+			t.Errorf("%v: got %d bytes, %v, want the uncompressed body", coding, len(b), err)
+		}
+	}
+}
+
+func TestServesHTTP2(t *testing.T) {
+	protocols := func(http1, http2, h2c bool) *http.Protocols {
+		p := new(http.Protocols)
+		p.SetHTTP1(http1)
+		p.SetHTTP2(http2)
+		p.SetUnencryptedHTTP2(h2c)
+		return p
+	}
+	tests := []struct {
+		name   string
+		server *http.Server
+		want   bool
+	}{
+		{name: "cleartext", server: &http.Server{}, want: false},
+		{name: "TLS", server: &http.Server{TLSConfig: &tls.Config{}}, want: true},
+		{name: "h2c", server: &http.Server{Protocols: protocols(true, false, true)}, want: true},
+		{name: "TLS without HTTP/2", server: &http.Server{TLSConfig: &tls.Config{}, Protocols: protocols(true, false, false)}, want: false},
+		{name: "HTTP/2 without TLS", server: &http.Server{Protocols: protocols(true, true, false)}, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := servesHTTP2(tt.server); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestKeepAliveInfoAfterShutdown(t *testing.T) {
+	tests := []struct {
+		name               string
+		drainCloseListener bool
+		want               bool
+	}{
+		{name: "keep-alives disabled on drain", want: false},
+		{name: "keep-alives kept on drain", drainCloseListener: true, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetShutdown(t)
+			set(t, &gracefulShutdown, true)
+			set(t, &drainCloseListener, tt.drainCloseListener)
+			ts := startServer(t, http.NotFoundHandler(), false)
+			client := &http.Client{Transport: &http.Transport{}}
+			shutdown(ts.Config, ts.Listener, client)
+
+			rec := httptest.NewRecorder()
+			keepAliveInfo(rec, client, ts.Config)
+			var info struct {
+				Server struct {
+					KeepAlivesEnabled bool `json:"keepAlivesEnabled"`
+				} `json:"server"`
+			}
+			if err := json.Unmarshal(rec.Body.Bytes(), &info); err != nil {
+				t.Fatal(err)
+			}
+			if info.Server.KeepAlivesEnabled != tt.want {
+				t.Errorf("got keepAlivesEnabled %v, want %v", info.Server.KeepAlivesEnabled, tt.want)
+			}
+		})
+	}
+}
+
+func TestMetricsDNSCache(t *testing.T) {
+	set(t, &resolverCache, newDNSCache(time.Minute))
+	for range 2 {
+		if _, err := resolverCache.lookup(context.Background(), "localhost"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rec := httptest.NewRecorder()
+	metrics(rec)
+	for _, want := range []string{
+		`client_dns_cache_lookups_total{result="hit"} 1`,
+		`client_dns_cache_lookups_total{result="miss"} 1`,
+		"client_dns_cache_entries 1",
+	} {
+		if !strings.Contains(rec.Body.String(), want+"\n") {
+			t.Errorf("metrics lack %v", want)
+		}
+	}
+}
+
+func TestMetricsAcceptLatency(t *testing.T) {
+	set(t, &acceptStats, newLatencyStats())
+	acceptStats.record(500 * time.Microsecond)
+	acceptStats.record(3 * time.Millisecond)
+	rec := httptest.NewRecorder()
+	metrics(rec)
+	for _, want := range []string{
+		`http_server_accept_to_first_request_seconds_bucket{le="0.001"} 1`,
+		`http_server_accept_to_first_request_seconds_bucket{le="0.002"} 1`,
+		`http_server_accept_to_first_request_seconds_bucket{le="0.004"} 2`,
+		`http_server_accept_to_first_request_seconds_bucket{le="+Inf"} 2`,
+		"http_server_accept_to_first_request_seconds_sum 0.0035",
+		"http_server_accept_to_first_request_seconds_count 2",
+	} {
+		if !strings.Contains(rec.Body.String(), want+"\n") {
+			t.Errorf("metrics lack %v", want)
+		}
+	}
+}
+
+func TestLoadSheddingExemptions(t *testing.T) {
+	// every request is shed as the connection count is above the limit
+	set(t, &shedThreshold, 1)
+	set(t, &shedLimit, 1)
+	numConnections.Add(2)
+	t.Cleanup(func() { numConnections.Add(-2) })
+	handler := withLoadShedding(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for path, want := range map[string]int{
+		"/sleep":       http.StatusServiceUnavailable,
+		"/metrics":     http.StatusOK,
+		"/saturation":  http.StatusOK,
+		"/ready":       http.StatusOK,
+		"/startup":     http.StatusOK,
+		"/drain-ready": http.StatusOK,
+	} {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		if rec.Code != want {
+			t.Errorf("%v: got %d, want %d", path, rec.Code, want)
+		}
+	}
+}
+
+func TestSleepChunksLimit(t *testing.T) {
+	for query, want := range map[string]int{
+		"chunks=0":         http.StatusBadRequest,
+		"chunks=1001":      http.StatusBadRequest,
+		"chunks=100000000": http.StatusBadRequest,
+		"chunks=1000":      http.StatusOK,
+	} {
+		rec := httptest.NewRecorder()
+		sleep(rec, httptest.NewRequest(http.MethodGet, "/sleep?min=0s&max=0s&"+query, nil))
+		if rec.Code != want {
+			t.Errorf("%v: got %d, want %d", query, rec.Code, want)
+		}
+	}
+}
+
+func TestSleepSampleCap(t *testing.T) {
+	set(t, &maxSleepSample, 2*time.Second)
+	set(t, &routeRequestDurations, map[string]time.Duration{"/sleep/short": time.Second})
+	pareto, err := buildInverseContinuousCDF("pareto", time.Second, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for path, want := range map[string]time.Duration{"/sleep": 2 * time.Second, "/sleep/short": time.Second} {
+		sampler := cappedSampler{latencySampler: pareto, max: sleepSampleCap(path)}
+		for range 1000 {
+			if d := sampler.Sample(); d < 0 || d > want {
+				t.Fatalf("%v: sampled %v, want at most %v", path, d, want)
+			}
+		}
+	}
+	if d := floatDuration(1e30); d != math.MaxInt64 {
+		t.Errorf("got %v for a sample beyond the range of Duration, want the maximum", d)
+	}
+}
+
+func TestIdleTrackingIgnoresProbes(t *testing.T) {
+	ts := startServer(t, withConnTracking(http.NotFoundHandler()), false)
+	for path, wantActivity := range map[string]bool{
+		"/ready":       false,
+		"/startup":     false,
+		"/drain-ready": false,
+		"/metrics":     false,
+		"/admin/env":   false,
+		"/sleep":       true,
+	} {
+		lastRequest.Store(1)
+		resp, err := http.Get(ts.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+		if activity := lastRequest.Load() != 1; activity != wantActivity {
+			t.Errorf("%v: got activity %v, want %v", path, activity, wantActivity)
+		}
+	}
+	lastRequest.Store(0)
+}
+
+func TestStatusSize(t *testing.T) {
+	tests := []struct {
+		method string
+		size   int
+		want   string
+	}{
+		{method: http.MethodGet, size: 8, want: "Returned"},
+		{method: http.MethodGet, size: 30, want: "Returned status code 200\n....."},
+		{method: http.MethodGet, size: 100 << 10, want: "Returned status code 200\n" + strings.Repeat(".", 100<<10-25)},
+		{method: http.MethodHead, size: maxBytes, want: ""},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		status(rec, httptest.NewRequest(tt.method, "/status?code=200&size="+strconv.Itoa(tt.size), nil))
+		if got := rec.Header().Get("Content-Length"); got != strconv.Itoa(tt.size) {
+			t.Errorf("%v %d: got Content-Length %v", tt.method, tt.size, got)
+		}
+		if rec.Body.String() != tt.want {
+			t.Errorf("%v %d: got %d body bytes, want %d", tt.method, tt.size, rec.Body.Len(), len(tt.want))
+		}
+	}
+}
+
+func TestAffinityDottedHostname(t *testing.T) {
+	set(t, &affinityCookie, "affinity")
+	set(t, &instanceID, func() string { return "pod.example.local-18f0" })
+	ts := startServer(t, withAffinity(http.NotFoundHandler()), false)
+	client := &http.Client{Transport: &http.Transport{}}
+	t.Cleanup(client.CloseIdleConnections)
+
+	var cookie *http.Cookie
+	for _, want := range []string{"new", "same-connection"} {
+		req, _ := http.NewRequest(http.MethodGet, ts.URL, nil)
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+		if got := resp.Header.Get("X-Affinity"); got != want {
+			t.Errorf("got X-Affinity %v, want %v", got, want)
+		}
+		if cookies := resp.Cookies(); cookie == nil && len(cookies) == 1 {
+			cookie = cookies[0]
+		} else if len(cookies) != 0 {
+			t.Errorf("got cookies %v for a known client", cookies)
+		}
+	}
+}
+
+func TestLocalURL(t *testing.T) {
+	for addr, want := range map[string]string{
+		":8080":          "http://localhost:8080",
+		":9090":          "http://localhost:9090",
+		"0.0.0.0:9090":   "http://localhost:9090",
+		"[::]:9090":      "http://localhost:9090",
+		"127.0.0.1:3000": "http://localhost:3000",
+	} {
+		if got := localURL(addr); got != want {
+			t.Errorf("%v: got %v, want %v", addr, got, want)
+		}
+	}
+}
+
+func TestShutdownWhenIdleTinyTimeout(t *testing.T) {
+	set(t, &maxIdleBeforeShutdown, 5*time.Nanosecond)
+	lastRequest.Store(0)
+	t.Cleanup(func() {
+		notReady.Store(false)
+		lastRequest.Store(0)
+		select {
+		case <-shutdownRequested:
+		default:
+		}
+	})
+	// panicked with a non-positive ticker interval before
+	shutdownWhenIdle()
+	if !notReady.Load() {
+		t.Error("shutdown was not requested")
+	}
+}
+
+func TestSleepPerConnectionCap(t *testing.T) {
+	set(t, &maxSleepSample, 20*time.Millisecond)
+	numConnections.Add(2)
+	t.Cleanup(func() { numConnections.Add(-2) })
+	// the second one overflowed to a negative duration before
+	for _, perConn := range []string{"1h", "2000000h"} {
+		start := time.Now()
+		rec := httptest.NewRecorder()
+		sleep(rec, httptest.NewRequest(http.MethodGet, "/sleep?min=0s&max=0s&per_conn="+perConn, nil))
+		if elapsed := time.Since(start); rec.Code != http.StatusOK || elapsed < 20*time.Millisecond || elapsed > time.Second {
+			t.Errorf("per_conn=%v: got %d after %v, want 200 after the cap of 20ms", perConn, rec.Code, elapsed)
+		}
+	}
+}